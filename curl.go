@@ -0,0 +1,400 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	gourl "net/url"
+	"strconv"
+	"strings"
+)
+
+// curlRequest is the request of a curl command line.
+type curlRequest struct {
+	method     string
+	url        string
+	header     http.Header
+	body       []byte // nil if there is none
+	user       string // username:password
+	proxy      string
+	insecure   bool
+	compressed bool
+	location   bool // follow redirects
+	http2      bool
+	maxTime    float64 // in seconds
+	cacert     string
+	cert       string
+	key        string
+
+	// warnings are the curl options that were ignored.
+	warnings []string
+}
+
+// curlIgnored are the curl options with no bearing on the requests sent,
+// such as those about the output, and whether they take an argument.
+var curlIgnored = map[string]bool{
+	"-s": false, "--silent": false, "-S": false, "--show-error": false,
+	"-v": false, "--verbose": false, "-i": false, "--include": false,
+	"-f": false, "--fail": false, "-#": false, "--progress-bar": false,
+	"--http1.1": false, "-o": true, "--output": true,
+}
+
+// curlUnsupported are the curl options that are not supported, and
+// whether they take an argument.
+var curlUnsupported = map[string]bool{
+	"-F": true, "--form": true, "-T": true, "--upload-file": true,
+	"--resolve": true, "--connect-to": true, "--connect-timeout": true,
+	"-c": true, "--cookie-jar": true, "-w": true, "--write-out": true,
+	"--limit-rate": true, "--retry": true, "-r": true, "--range": true,
+	"-K": true, "--config": true, "--retry-delay": true, "--retry-max-time": true,
+	"--max-redirs": true, "-y": true, "--speed-time": true, "-Y": true,
+	"--speed-limit": true, "--interface": true, "--dns-servers": true,
+	"--local-port": true, "--max-filesize": true, "--ciphers": true,
+	"--tls-max": true, "--capath": true, "--pinnedpubkey": true,
+	"--cert-type": true, "--key-type": true, "--pass": true, "--proxy-user": true,
+	"-U": true, "--noproxy": true, "--unix-socket": true, "-z": true,
+	"--time-cond": true, "-Q": true, "--quote": true, "--keepalive-time": true,
+	"--expect100-timeout": true, "--happy-eyeballs-timeout-ms": true,
+	"--request-target": true, "--aws-sigv4": true, "--variable": true,
+}
+
+// loadCurl parses a curl command line, or the one in the file named
+// after @, such as @request.sh.
+func loadCurl(s string) (*curlRequest, error) {
+	if strings.HasPrefix(s, "@") {
+		b, err := ioutil.ReadFile(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+	args, err := splitShell(s)
+	if err != nil {
+		return nil, err
+	}
+	return parseCurl(args)
+}
+
+// parseCurl builds a request from the arguments of a curl command line.
+func parseCurl(args []string) (*curlRequest, error) {
+	if len(args) > 0 && args[0] == "curl" {
+		args = args[1:]
+	}
+	r := &curlRequest{header: make(http.Header)}
+	var data []string
+	var get bool
+	var unknown string // the unknown option just before, if any
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		if !strings.HasPrefix(arg, "-") {
+			if r.url != "" && unknown != "" {
+				return nil, fmt.Errorf("curl option %s is not supported and may take the argument %q, remove it from the command", unknown, arg)
+			}
+			if r.url != "" {
+				return nil, fmt.Errorf("curl command has a second URL %q", arg)
+			}
+			r.url = arg
+			continue
+		}
+		unknown = ""
+
+		// Split combined short options, such as -sSL or -XPOST.
+		name, value, hasValue := arg, "", false
+		if !strings.HasPrefix(arg, "--") && len(arg) > 2 {
+			name = arg[:2]
+			if curlTakesArg(name) {
+				value, hasValue = arg[2:], true
+			} else {
+				args = append([]string{"-" + arg[2:]}, args...)
+			}
+		}
+		if curlTakesArg(name) && !hasValue {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("curl option %s needs an argument", name)
+			}
+			value, args = args[0], args[1:]
+		}
+
+		switch name {
+		case "--url":
+			if r.url != "" {
+				return nil, fmt.Errorf("curl command has a second URL %q", value)
+			}
+			r.url = value
+		case "-X", "--request":
+			r.method = strings.ToUpper(value)
+		case "-H", "--header":
+			i := strings.Index(value, ":")
+			if i <= 0 {
+				// "Name;" sends an empty header, and "Name:" removes one.
+				if strings.HasSuffix(value, ";") {
+					r.header.Add(strings.TrimSuffix(value, ";"), "")
+				}
+				continue
+			}
+			k, v := strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+			if v == "" {
+				r.header.Del(k)
+				continue
+			}
+			r.header.Add(k, v)
+		case "-d", "--data", "--data-ascii", "--data-binary", "--data-raw", "--data-urlencode", "--json":
+			if name == "--data-urlencode" {
+				value = curlURLEncode(value)
+			} else if name != "--data-raw" && strings.HasPrefix(value, "@") {
+				b, err := ioutil.ReadFile(value[1:])
+				if err != nil {
+					return nil, err
+				}
+				value = string(b)
+				if name == "-d" || name == "--data" || name == "--data-ascii" {
+					value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+				}
+			}
+			if name == "--json" {
+				if r.header.Get("Content-Type") == "" {
+					r.header.Set("Content-Type", "application/json")
+				}
+				if r.header.Get("Accept") == "" {
+					r.header.Set("Accept", "application/json")
+				}
+			}
+			data = append(data, value)
+		case "-G", "--get":
+			get = true
+		case "-I", "--head":
+			r.method = "HEAD"
+		case "-u", "--user":
+			r.user = value
+		case "-A", "--user-agent":
+			r.header.Set("User-Agent", value)
+		case "-e", "--referer":
+			r.header.Set("Referer", value)
+		case "-b", "--cookie":
+			if !strings.Contains(value, "=") {
+				// Without a "=", it names a file of cookies.
+				r.warnings = append(r.warnings, name)
+				continue
+			}
+			r.header.Add("Cookie", value)
+		case "--oauth2-bearer":
+			r.header.Set("Authorization", "Bearer "+value)
+		case "-x", "--proxy":
+			r.proxy = value
+		case "-k", "--insecure":
+			r.insecure = true
+		case "--cacert":
+			r.cacert = value
+		case "-E", "--cert":
+			// The certificate may be followed by :password, which is not
+			// supported.
+			if i := strings.Index(value, ":"); i >= 0 {
+				value = value[:i]
+				r.warnings = append(r.warnings, name+" password")
+			}
+			r.cert = value
+		case "--key":
+			r.key = value
+		case "--compressed":
+			r.compressed = true
+		case "-L", "--location":
+			r.location = true
+		case "--http2", "--http2-prior-knowledge":
+			r.http2 = true
+		case "-m", "--max-time":
+			t, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid curl %s %q", name, value)
+			}
+			r.maxTime = t
+		default:
+			if _, ok := curlIgnored[name]; !ok {
+				r.warnings = append(r.warnings, name)
+				unknown = name
+			}
+		}
+	}
+	if r.url == "" {
+		return nil, errors.New("curl command has no URL")
+	}
+	if strings.Index(r.url, "://") < 0 {
+		r.url = "http://" + r.url
+	}
+
+	if len(data) > 0 {
+		joined := strings.Join(data, "&")
+		if get {
+			sep := "?"
+			if strings.Contains(r.url, "?") {
+				sep = "&"
+			}
+			r.url += sep + joined
+		} else {
+			r.body = []byte(joined)
+			if r.method == "" {
+				r.method = "POST"
+			}
+			if r.header.Get("Content-Type") == "" {
+				r.header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+		}
+	}
+	if r.method == "" {
+		r.method = "GET"
+	}
+	return r, nil
+}
+
+// curlTakesArg reports whether the curl option takes an argument.
+func curlTakesArg(name string) bool {
+	switch name {
+	case "--url", "-X", "--request", "-H", "--header", "-d", "--data",
+		"--data-ascii", "--data-binary", "--data-raw", "--data-urlencode", "--json",
+		"-u", "--user", "-A", "--user-agent", "-e", "--referer", "-b", "--cookie",
+		"--oauth2-bearer", "-x", "--proxy", "-m", "--max-time",
+		"--cacert", "-E", "--cert", "--key":
+		return true
+	}
+	return curlIgnored[name] || curlUnsupported[name]
+}
+
+// curlURLEncode encodes the argument of --data-urlencode, which is either
+// content, =content or name=content.
+func curlURLEncode(s string) string {
+	i := strings.Index(s, "=")
+	switch {
+	case i < 0:
+		return gourl.QueryEscape(s)
+	case i == 0:
+		return gourl.QueryEscape(s[1:])
+	}
+	return s[:i] + "=" + gourl.QueryEscape(s[i+1:])
+}
+
+// splitShell splits a command line into its arguments, as a POSIX shell
+// does, with single, double and $'...' quotes, backslash escapes and
+// line continuations.
+func splitShell(s string) ([]string, error) {
+	var args []string
+	var cur []byte
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] != '\n' {
+				cur = append(cur, s[i])
+				inArg = true
+			}
+		case c == '\'':
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return nil, errors.New("unterminated ' quote")
+			}
+			cur = append(cur, s[i+1:i+1+j]...)
+			i += j + 1
+			inArg = true
+		case c == '$' && i+1 < len(s) && s[i+1] == '\'':
+			b, n, err := unquoteANSI(s[i+2:])
+			if err != nil {
+				return nil, err
+			}
+			cur = append(cur, b...)
+			i += n + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				cur = append(cur, s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New(`unterminated " quote`)
+			}
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, string(cur))
+				cur, inArg = nil, false
+			}
+		default:
+			cur = append(cur, c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, string(cur))
+	}
+	return args, nil
+}
+
+// unquoteANSI decodes the body of a $'...' quote, such as those of
+// commands copied from browsers, and returns it along with the length of
+// s it took, including the closing quote.
+func unquoteANSI(s string) ([]byte, int, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' {
+			return b, i + 1, nil
+		}
+		if c != '\\' || i+1 >= len(s) {
+			b = append(b, c)
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			b = append(b, '\n')
+		case 't':
+			b = append(b, '\t')
+		case 'r':
+			b = append(b, '\r')
+		case 'x':
+			if i+2 < len(s) {
+				if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					b = append(b, byte(v))
+					i += 2
+					continue
+				}
+			}
+			b = append(b, '\\', c)
+		case 'u':
+			if i+4 < len(s) {
+				if v, err := strconv.ParseUint(s[i+1:i+5], 16, 16); err == nil {
+					b = append(b, string(rune(v))...)
+					i += 4
+					continue
+				}
+			}
+			b = append(b, '\\', c)
+		case '\\', '\'', '"', '?':
+			b = append(b, c)
+		default:
+			b = append(b, '\\', c)
+		}
+	}
+	return nil, 0, errors.New("unterminated $' quote")
+}
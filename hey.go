@@ -16,6 +16,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +27,7 @@ import (
 	"os/signal"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,13 +51,42 @@ var (
 	hostHeader  = flag.String("host", "", "")
 	userAgent   = flag.String("U", "", "")
 
-	output = flag.String("o", "", "")
+	output    = flag.String("o", "", "")
+	resultLog = flag.String("result-log", "", "")
 
-	c = flag.Int("c", 50, "")
-	n = flag.Int("n", 200, "")
-	q = flag.Float64("q", 0, "")
-	t = flag.Int("t", 20, "")
-	z = flag.Duration("z", 0, "")
+	warmUp  = flag.Duration("warmup", 0, "")
+	warmUpN = flag.Int("warmup-n", 0, "")
+
+	window    = flag.Duration("window", 0, "")
+	windowOut = flag.String("window-out", "", "")
+
+	progressInterval = flag.Duration("progress-interval", 0, "")
+	disableProgress  = flag.Bool("disable-progress", false, "")
+
+	precision = flag.Int("precision", 3, "")
+
+	expectStatus = flag.String("expect-status", "", "")
+	expectBody   = flag.String("expect-body", "", "")
+	expectSize   = flag.String("expect-size", "", "")
+
+	c  = flag.Int("c", 50, "")
+	n  = flag.Int("n", 200, "")
+	q  = flag.Float64("q", 0, "")
+	gq = flag.Float64("Q", 0, "")
+	r  = flag.Float64("R", 0, "")
+	t  = flag.Int("t", 20, "")
+	z  = flag.Duration("z", 0, "")
+
+	stages = flag.String("stages", "", "")
+
+	search       = flag.String("search", "", "")
+	searchStart  = flag.Float64("search-start", 10, "")
+	searchStep   = flag.Float64("search-step", 10, "")
+	searchMax    = flag.Float64("search-max", 1000, "")
+	searchWindow = flag.Duration("search-window", 10*time.Second, "")
+	searchBisect = flag.Bool("search-bisect", false, "")
+	sloP99       = flag.Duration("slo-p99", 0, "")
+	sloErrors    = flag.Float64("slo-errors", 0.01, "")
 
 	h2   = flag.Bool("h2", false, "")
 	cpus = flag.Int("cpus", runtime.GOMAXPROCS(-1), "")
@@ -63,22 +94,127 @@ var (
 	disableCompression = flag.Bool("disable-compression", false, "")
 	disableKeepAlives  = flag.Bool("disable-keepalive", false, "")
 	disableRedirects   = flag.Bool("disable-redirects", false, "")
+	cookies            = flag.Bool("cookies", false, "")
+	workerConns        = flag.Bool("worker-conns", false, "")
+	conns              = flag.Int("conns", 0, "")
+	maxConnsPerHost    = flag.Int("max-conns-per-host", 0, "")
 	proxyAddr          = flag.String("x", "", "")
+
+	caCert     = flag.String("cacert", "", "")
+	tlsVerify  = flag.Bool("tls-verify", false, "")
+	clientCert = flag.String("cert", "", "")
+	clientKey  = flag.String("key", "", "")
+	sni        = flag.String("sni", "", "")
+	tlsMin     = flag.String("tls-min", "", "")
+	tlsMax     = flag.String("tls-max", "", "")
+	ciphers    = flag.String("ciphers", "", "")
+
+	templated = flag.Bool("template", false, "")
+	dataFile  = flag.String("data", "", "")
+	dataMode  = flag.String("data-mode", "sequential", "")
+
+	targetsFile  = flag.String("targets", "", "")
+	targetsOrder = flag.String("targets-order", "round-robin", "")
+
+	curlCmd = flag.String("curl", "", "")
+
+	scenarioFile = flag.String("scenario", "", "")
+
+	harFile   = flag.String("har", "", "")
+	harTiming = flag.Bool("har-timing", false, "")
+
+	replayFile  = flag.String("replay", "", "")
+	replaySpeed = flag.Float64("replay-speed", 1, "")
 )
 
 var usage = `Usage: hey [options...] <url>
+       hey [options...] -targets <file>
+       hey [options...] -scenario <file>
+       hey [options...] -curl <curl command line>
+       hey [options...] -har <file>
+       hey [options...] -replay <access log> <base url>
 
 Options:
   -n  Number of requests to run. Default is 200.
   -c  Number of workers to run concurrently. Total number of requests cannot
       be smaller than the concurrency level. Default is 50.
   -q  Rate limit, in queries per second (QPS) per worker. Default is no rate limit.
+  -Q  Rate limit, in queries per second (QPS) across all workers. Unlike -q,
+      the total rate does not change with -c.
+  -R  Open-loop arrival rate, in requests per second across all workers.
+      Requests are sent on a fixed schedule however slow the responses are,
+      and latencies are measured from each request's scheduled send time.
+      Overrides -q.
   -z  Duration of application to send requests. When duration is reached,
       application stops and exits. If duration is specified, n is ignored.
       Examples: -z 10s -z 3m.
+  -stages  Load profile, as a comma-separated list of duration:target
+      stages. The load ramps linearly from one target to the next over
+      the duration of each stage, starting from zero. A target is a
+      number of workers, or a rate in requests per second if suffixed
+      with /s. If set, -n is ignored, and so is -c for worker targets.
+      Results are also reported per stage.
+      Examples: -stages 30s:10,1m:10,30s:0 -stages 1m:100/s,5m:100/s.
+  -search  Search for the highest load the server sustains within -slo-p99
+      and -slo-errors, by measuring increasing load levels for
+      -search-window each, and print a table of the levels tried.
+      "c" searches the number of workers, "rate" the arrival rate (-R).
+  -search-start, -search-step, -search-max  Levels to try.
+      Default is 10, 10 and 1000.
+  -search-window  How long to measure each level for. Default is 10s.
+  -search-bisect  Bisect between -search-start and -search-max instead
+      of trying every step.
+  -slo-p99     Highest acceptable 99th percentile latency, e.g. 200ms.
+  -slo-errors  Highest acceptable fraction of failed (error or 5xx)
+      requests. Default is 0.01.
   -o  Output type. If none provided, a summary is printed.
-      "csv" is the only supported alternative. Dumps the response
-      metrics in comma-separated values format.
+      "csv" dumps the response metrics in comma-separated values format.
+      "json" prints the summary as a JSON document.
+      Any other value is a Go text/template executed with the report,
+      in which a literal %% may also be written %%%%.
+  -expect-status  Allowed response status codes, comma separated. A code
+      class such as 2xx allows all codes of the class. Responses that do
+      not meet an -expect option are reported as failures.
+  -expect-header  Required response header as "Name: regexp", where the
+      regexp may be empty. Can be repeated.
+  -expect-body  Regexp the response body must match.
+  -expect-json  JSON field of the response body that must exist, as a
+      path such as data.items.0.id, or have a value, as path=value.
+      Can be repeated.
+  -expect-size  Allowed response body size in bytes, as min:max, where
+      either bound may be left out.
+  -threshold  Condition the results must meet, such as "p95<200ms",
+      "error_rate<0.1%%", "rps>1000" or "5xx==0". Can be repeated. If any
+      threshold fails, hey exits with status 2. Metrics are p50, p95,
+      p99, p99.9 and the other reported percentiles, avg, fastest,
+      slowest, rps, error_rate and the 2xx to 5xx response counts.
+      error_rate counts errors, 5xx responses and responses not matching
+      -expect, as -slo-errors does.
+  -precision  Number of significant digits latencies are recorded with,
+      from 1 to 5. Default is 3. Each histogram, of which there is one
+      per phase, label, stage and window, takes up to about 140KB at 3
+      and 10MB at 5 for latencies of a minute.
+  -progress-interval  Print a line of statistics for each interval of
+      the given length to stderr while the run goes, such as for CI logs.
+      Example: -progress-interval 10s.
+  -disable-progress  Disable the live progress display, which is shown
+      on stderr when it is a terminal.
+  -warmup  Warm-up duration, such as 10s. Requests are sent as usual
+      during the warm-up, but their results are reported separately and
+      left out of the other statistics. -z is extended by the warm-up;
+      with -stages the warm-up is the start of the profile.
+  -warmup-n  Number of warm-up requests, which -n is extended by.
+  -window  Split the results into time windows of the given length, by
+      the time the requests were started, and report the throughput,
+      latency percentiles, errors and status code classes of each.
+      They are included in -o json output. Example: -window 10s.
+  -window-out  File to write the time windows to, as CSV, or as one JSON
+      object per line if the file name ends in .json.
+  -result-log  File to stream every result to as it completes, including
+      failed requests, as one JSON object per line with the start time,
+      URL, label, status code, phase durations, size and error. Whole
+      runs of a -scenario are marked with "scenario": true. The file
+      is flushed every second.
 
   -m  HTTP method, one of GET, POST, PUT, DELETE, HEAD, OPTIONS.
   -H  Custom HTTP header. You can specify as many as needed by repeating the flag.
@@ -91,6 +227,78 @@ Options:
   -U  User-Agent, defaults to version "hey/0.0.1".
   -a  Basic authentication, username:password.
   -x  HTTP Proxy address as host:port.
+  -cacert  PEM file of the certificate authorities to verify the
+      certificates of servers against. Implies -tls-verify.
+  -tls-verify  Verify the certificates of servers, against -cacert or
+      else the system roots. By default they are not verified.
+  -cert  PEM client certificate to present to servers that ask for one,
+      such as for mutual TLS. Requires -key.
+  -key  PEM private key of -cert.
+  -sni  Server name to send for SNI, and verify. Defaults to -host, or
+      else the host of the URL.
+  -tls-min  Minimum TLS version: 1.0, 1.1, 1.2 or 1.3.
+  -tls-max  Maximum TLS version: 1.0, 1.1, 1.2 or 1.3.
+  -ciphers  Cipher suites allowed for TLS 1.2 and below, comma separated,
+      such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+  -targets  File of requests to send instead of <url>, one JSON object
+      per line, such as {"method": "POST", "url": "http://host/items",
+      "headers": {"X-Id": "1"}, "body_file": "item.json", "label": "create",
+      "weight": 2}. Only "url" is required; "body" gives the body inline.
+      Headers from the other options apply to every request. Results are
+      also reported per target.
+  -targets-order  How to pick the target of each request: round-robin,
+      random or weighted. Default is round-robin.
+  -har  HAR file, such as a session recorded by a browser, to replay
+      instead of <url>. Each worker sends its requests in order, over and
+      over, as fast as it can. Unless -n or -z is set, each worker
+      replays them once. Headers of -H and -a replace the recorded ones.
+      Results are also reported per entry.
+  -har-timing  Keep the recorded timing of -har: each request is sent no
+      sooner after the first one than it was in the recording.
+  -replay  Web server access log to replay on <url>, in the Common or
+      Combined Log Format, or JSON Lines with "method", "path" and
+      "time" fields. Each request is sent once, at the time it was
+      received since the first one, however slow the responses, by the
+      first of the -c workers free. The summary compares when they were
+      sent with the schedule. -n, -q, -Q, -R and -stages are ignored.
+  -replay-speed  How many times faster than recorded to replay the
+      requests of -replay. Default is 1.
+  -scenario  JSON file of the steps a virtual user goes through, run by
+      every worker over and over instead of requesting <url>, such as
+      {"name": "browse", "steps": [{"name": "login", "method": "POST",
+      "url": "http://host/login", "body": "{\"user\": \"{{data.user}}\"}",
+      "extract": {"token": "json:token"}, "think_time": "1s"}, {"name":
+      "item", "url": "http://host/items/1", "headers": {"Authorization":
+      "Bearer {{var.token}}"}}]}. "extract" takes values from responses
+      into variables, as json:<path>, regex:<regexp>, header:<name> or
+      cookie:<name>, which later steps use as {{var.name}}; steps are
+      templates, as with -template. -n counts runs of the scenario, and
+      results are also reported per step and for whole runs, without
+      think times.
+  -template  Replace placeholders in the URL path and query, header
+      values and body of every request, including those of -targets:
+      {{seq}} the number of the request, from 1; {{worker}} the number
+      of the worker, from 0; {{uuid}} a random UUID; {{randInt 1 100}} a
+      random integer in a range; {{randString 8}} a random string of a
+      length; {{timestamp}} and {{timestampMs}} the Unix time in seconds
+      and milliseconds. For example, -template -d '{"id": "{{uuid}}"}'.
+  -data  CSV file, with a header line naming the fields, or JSON Lines
+      file, if its name ends in .jsonl, .ndjson or .json, of data rows
+      for the requests. Each request gets a row, whose fields are the
+      {{data.name}} placeholders of its URL, headers and body. Implies
+      -template.
+  -data-mode  How rows are given to requests: sequential cycles through
+      them, random picks them at random, and unique gives each row to a
+      single request, and stops the run once they are all used. Default
+      is sequential.
+  -curl  Curl command line to take the request from, such as one copied
+      from API docs or browser devtools, or @file to read it from a file.
+      Its URL, method, headers, body, user, proxy, --compressed, -L,
+      --http2, --max-time, --cacert, --cert and --key are used, and the
+      options of hey set explicitly take precedence. Without --compressed
+      and -L, responses are not compressed and redirects not followed, as
+      with curl. Curl options that are not supported are ignored with a
+      warning, unless they seem to take an argument, which is an error.
   -h2 Enable HTTP/2.
 
   -host	HTTP Host header.
@@ -99,6 +307,17 @@ Options:
   -disable-keepalive    Disable keep-alive, prevents re-use of TCP
                         connections between different HTTP requests.
   -disable-redirects    Disable following of HTTP redirects
+  -cookies              Give each worker a cookie jar of its own, which
+                        keeps the cookies set by responses, including
+                        redirects and login steps, as a browser session.
+  -worker-conns         Give each worker connections of its own, rather
+                        than a pool shared by all of them.
+  -conns                Number of connections the workers share, each
+                        worker always sending on the same one, such as to
+                        spread HTTP/2 requests over several connections.
+                        Default is a pool shared by all of them.
+  -max-conns-per-host   Maximum number of connections of each pool to a
+                        host. Default is no limit.
   -cpus                 Number of used cpu cores.
                         (default for current machine is %d cores)
 `
@@ -110,9 +329,24 @@ func main() {
 
 	var hs headerSlice
 	flag.Var(&hs, "H", "")
+	var expectHeaders, expectJSON headerSlice
+	flag.Var(&expectHeaders, "expect-header", "")
+	flag.Var(&expectJSON, "expect-json", "")
+	var thresholdFlags headerSlice
+	flag.Var(&thresholdFlags, "threshold", "")
 
 	flag.Parse()
-	if flag.NArg() < 1 {
+	var curl *curlRequest
+	if *curlCmd != "" {
+		var err error
+		if curl, err = loadCurl(*curlCmd); err != nil {
+			errAndExit(err.Error())
+		}
+		for _, name := range curl.warnings {
+			fmt.Fprintf(os.Stderr, "warning: curl option %s is not supported, ignoring it\n", name)
+		}
+	}
+	if flag.NArg() < 1 && *targetsFile == "" && *harFile == "" && *scenarioFile == "" && curl == nil {
 		usageAndExit("")
 	}
 
@@ -122,7 +356,25 @@ func main() {
 	q := *q
 	dur := *z
 
-	if dur > 0 {
+	globalQPS := *gq > 0
+	if globalQPS {
+		if q > 0 {
+			usageAndExit("-q and -Q cannot be used together.")
+		}
+		q = *gq
+	}
+
+	var profile []requester.Stage
+	if *stages != "" {
+		var err error
+		if profile, err = parseStages(*stages); err != nil {
+			usageAndExit(err.Error())
+		}
+		num = math.MaxInt32
+		if conc <= 0 {
+			usageAndExit("-c cannot be smaller than 1.")
+		}
+	} else if dur > 0 {
 		num = math.MaxInt32
 		if conc <= 0 {
 			usageAndExit("-c cannot be smaller than 1.")
@@ -137,12 +389,49 @@ func main() {
 		}
 	}
 
-	url := flag.Args()[0]
+	if *warmUp < 0 || *warmUpN < 0 {
+		usageAndExit("-warmup and -warmup-n cannot be negative.")
+	}
+	if *precision < 1 || *precision > 5 {
+		usageAndExit("-precision must be from 1 to 5.")
+	}
+	if *conns < 0 || *maxConnsPerHost < 0 {
+		usageAndExit("-conns and -max-conns-per-host cannot be negative.")
+	}
+	if *conns > 0 && *workerConns {
+		usageAndExit("-conns and -worker-conns cannot be used together.")
+	}
+	if *stages == "" {
+		if dur > 0 {
+			dur += *warmUp
+		} else {
+			num += *warmUpN
+		}
+	}
+
+	url := flag.Arg(0)
 	method := strings.ToUpper(*m)
+	if curl != nil {
+		if url == "" {
+			url = curl.url
+		}
+		if !flagSet("m") {
+			method = curl.method
+		}
+	}
 
 	// set content-type
 	header := make(http.Header)
-	header.Set("Content-Type", *contentType)
+	if curl == nil || flagSet("T") {
+		header.Set("Content-Type", *contentType)
+	}
+	if curl != nil {
+		for k, v := range curl.header {
+			if _, ok := header[k]; !ok {
+				header[k] = v
+			}
+		}
+	}
 	// set any other additional headers
 	if *headers != "" {
 		usageAndExit("Flag '-h' is deprecated, please use '-H' instead.")
@@ -168,6 +457,12 @@ func main() {
 			usageAndExit(err.Error())
 		}
 		username, password = match[1], match[2]
+	} else if curl != nil && curl.user != "" {
+		i := strings.Index(curl.user, ":")
+		if i < 0 {
+			usageAndExit("curl -u must be username:password.")
+		}
+		username, password = curl.user[:i], curl.user[i+1:]
 	}
 
 	var bodyAll []byte
@@ -181,16 +476,87 @@ func main() {
 		}
 		bodyAll = slurp
 	}
+	if curl != nil && bodyAll == nil {
+		bodyAll = curl.body
+	}
 
+	var feeder *requester.Feeder
+	if *dataFile != "" {
+		var err error
+		if feeder, err = requester.LoadFeeder(*dataFile, *dataMode); err != nil {
+			usageAndExit(err.Error())
+		}
+	}
+
+	var thresholds []requester.Threshold
+	for _, v := range thresholdFlags {
+		t, err := requester.ParseThreshold(v)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		thresholds = append(thresholds, t)
+	}
+
+	expect, err := parseExpect(*expectStatus, expectHeaders, *expectBody, expectJSON, *expectSize)
+	if err != nil {
+		usageAndExit(err.Error())
+	}
+
+	proxy := *proxyAddr
+	if curl != nil && proxy == "" {
+		proxy = curl.proxy
+	}
 	var proxyURL *gourl.URL
-	if *proxyAddr != "" {
+	if proxy != "" {
 		var err error
-		proxyURL, err = gourl.Parse(*proxyAddr)
+		proxyURL, err = gourl.Parse(proxy)
 		if err != nil {
 			usageAndExit(err.Error())
 		}
 	}
 
+	timeout := *t
+	compression, redirects, http2 := !*disableCompression, !*disableRedirects, *h2
+	if curl != nil {
+		if !flagSet("t") && curl.maxTime > 0 {
+			timeout = int(math.Ceil(curl.maxTime))
+		}
+		compression = compression && curl.compressed
+		redirects = redirects && curl.location
+		http2 = http2 || curl.http2
+	}
+
+	tlsOpts := requester.TLSOptions{
+		CAFile:     *caCert,
+		Verify:     *tlsVerify,
+		CertFile:   *clientCert,
+		KeyFile:    *clientKey,
+		ServerName: *sni,
+		MinVersion: *tlsMin,
+		MaxVersion: *tlsMax,
+	}
+	if *ciphers != "" {
+		tlsOpts.CipherSuites = strings.Split(*ciphers, ",")
+	}
+	if curl != nil {
+		// Certificates are only verified if asked, so curl -k only makes
+		// a difference to --cacert.
+		if tlsOpts.CAFile == "" && !curl.insecure {
+			tlsOpts.CAFile = curl.cacert
+		}
+		if tlsOpts.CertFile == "" && tlsOpts.KeyFile == "" {
+			tlsOpts.CertFile, tlsOpts.KeyFile = curl.cert, curl.key
+			if tlsOpts.KeyFile == "" {
+				// curl reads the key from the certificate file if it has none.
+				tlsOpts.KeyFile = curl.cert
+			}
+		}
+	}
+	tlsConfig, err := tlsOpts.Config()
+	if err != nil {
+		usageAndExit(err.Error())
+	}
+
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		usageAndExit(err.Error())
@@ -203,6 +569,9 @@ func main() {
 	// set host header if set
 	if *hostHeader != "" {
 		req.Host = *hostHeader
+	} else if curl != nil && curl.header.Get("Host") != "" {
+		req.Host = curl.header.Get("Host")
+		header.Del("Host")
 	}
 
 	ua := header.Get("User-Agent")
@@ -221,35 +590,259 @@ func main() {
 
 	req.Header = header
 
-	w := &requester.Work{
-		Request:            req,
-		RequestBody:        bodyAll,
-		N:                  num,
-		C:                  conc,
-		QPS:                q,
-		Timeout:            *t,
-		DisableCompression: *disableCompression,
-		DisableKeepAlives:  *disableKeepAlives,
-		DisableRedirects:   *disableRedirects,
-		H2:                 *h2,
-		ProxyAddr:          proxyURL,
-		Output:             *output,
-	}
-	w.Init()
+	var targets []*requester.Target
+	if *targetsFile != "" {
+		switch *targetsOrder {
+		case "round-robin", "random", "weighted":
+		default:
+			usageAndExit("-targets-order must be round-robin, random or weighted.")
+		}
+		if *hostHeader != "" {
+			usageAndExit("-host cannot be used with -targets.")
+		}
+		targets, err = requester.LoadTargets(*targetsFile)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		for _, t := range targets {
+			t.Header = mergeHeaders(header, username, password, t.Header)
+		}
+		req = nil
+	}
+	order := *targetsOrder
+	if *harFile != "" {
+		if *targetsFile != "" {
+			usageAndExit("-har and -targets cannot be used together.")
+		}
+		if *hostHeader != "" {
+			usageAndExit("-host cannot be used with -har.")
+		}
+		targets, err = requester.LoadHAR(*harFile)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		// Recorded headers are kept, but those of -H and -a replace them.
+		for _, t := range targets {
+			for _, h := range hs {
+				match, _ := parseInputWithRegexp(h, headerRegexp)
+				t.Header.Set(match[1], match[2])
+			}
+			if username != "" || password != "" {
+				tr := &http.Request{Header: t.Header}
+				tr.SetBasicAuth(username, password)
+			}
+		}
+		if !flagSet("n") && *stages == "" && dur <= 0 {
+			num = len(targets)*conc + *warmUpN
+		}
+		order = "session"
+		req = nil
+	} else if *harTiming {
+		usageAndExit("-har-timing requires -har.")
+	}
+	if *replayFile != "" {
+		if *targetsFile != "" || *harFile != "" {
+			usageAndExit("-replay cannot be used with -targets or -har.")
+		}
+		if *hostHeader != "" {
+			usageAndExit("-host cannot be used with -replay.")
+		}
+		if *replaySpeed <= 0 {
+			usageAndExit("-replay-speed must be greater than 0.")
+		}
+		targets, err = requester.LoadAccessLog(*replayFile, url)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		for _, t := range targets {
+			t.Header = req.Header
+		}
+		num = len(targets)
+		req = nil
+	}
+
+	var scenario *requester.Scenario
+	if *scenarioFile != "" {
+		if len(targets) > 0 {
+			usageAndExit("-scenario cannot be used with -targets, -har or -replay.")
+		}
+		if *hostHeader != "" {
+			usageAndExit("-host cannot be used with -scenario.")
+		}
+		scenario, err = requester.LoadScenario(*scenarioFile)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		for _, st := range scenario.Steps {
+			st.Header = mergeHeaders(header, username, password, st.Header)
+		}
+		req = nil
+	}
 
+	newWork := func() *requester.Work {
+		return &requester.Work{
+			Request:            req,
+			Targets:            targets,
+			Scenario:           scenario,
+			TargetOrder:        order,
+			KeepTiming:         *harTiming,
+			Replay:             *replayFile != "",
+			ReplaySpeed:        *replaySpeed,
+			RequestBody:        bodyAll,
+			Templated:          *templated,
+			Feeder:             feeder,
+			N:                  num,
+			C:                  conc,
+			QPS:                q,
+			GlobalQPS:          globalQPS,
+			Rate:               *r,
+			Stages:             profile,
+			Timeout:            timeout,
+			DisableCompression: !compression,
+			DisableKeepAlives:  *disableKeepAlives,
+			DisableRedirects:   !redirects,
+			CookieJars:         *cookies,
+			WorkerConnections:  *workerConns,
+			Connections:        *conns,
+			MaxConnsPerHost:    *maxConnsPerHost,
+			H2:                 http2,
+			ProxyAddr:          proxyURL,
+			TLSConfig:          tlsConfig,
+			Output:             *output,
+			HistogramPrecision: *precision,
+			WarmUp:             *warmUp,
+			WarmUpRequests:     *warmUpN,
+			Expect:             expect,
+		}
+	}
+
+	if *windowOut != "" && *window <= 0 {
+		usageAndExit("-window-out requires -window.")
+	}
+
+	if *search != "" {
+		if *search != "c" && *search != "rate" {
+			usageAndExit("-search must be c or rate.")
+		}
+		if *sloP99 <= 0 {
+			usageAndExit("-search requires -slo-p99.")
+		}
+		if *searchStep <= 0 || *searchStart <= 0 || *searchMax < *searchStart {
+			usageAndExit("Invalid -search-start, -search-step or -search-max.")
+		}
+		s := &requester.Search{
+			NewWork:      newWork,
+			Rate:         *search == "rate",
+			Start:        *searchStart,
+			Step:         *searchStep,
+			Max:          *searchMax,
+			Bisect:       *searchBisect,
+			Window:       *searchWindow,
+			P99:          *sloP99,
+			MaxErrorRate: *sloErrors,
+		}
+		s.Run()
+		return
+	}
+
+	w := newWork()
+	if *resultLog != "" {
+		f, err := os.Create(*resultLog)
+		if err != nil {
+			errAndExit(err.Error())
+		}
+		defer f.Close()
+		w.ResultLog = f
+	}
+	w.Thresholds = thresholds
+	w.Window = *window
+	if *progressInterval > 0 {
+		w.Progress = os.Stderr
+		w.ProgressInterval = *progressInterval
+		w.ProgressLines = true
+	} else if !*disableProgress && isTerminal(os.Stderr) {
+		w.Progress = os.Stderr
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if dur > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, dur)
+		defer stop()
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
-		w.Stop()
+		// Let a second interrupt kill the process.
+		signal.Stop(c)
+		cancel()
 	}()
-	if dur > 0 {
-		go func() {
-			time.Sleep(dur)
-			w.Stop()
-		}()
+	rep, err := w.RunContext(ctx)
+	if rep == nil {
+		errAndExit(err.Error())
+	}
+	if err := rep.Print(os.Stdout, *output); err != nil {
+		errAndExit(err.Error())
+	}
+	if *windowOut != "" {
+		if err := writeWindows(rep, *windowOut); err != nil {
+			errAndExit(err.Error())
+		}
+	}
+	if !rep.Passed() {
+		os.Exit(2)
 	}
-	w.Run()
+}
+
+// writeWindows writes the time windows of rep to the named file, as JSON
+// if its name ends in .json and as CSV otherwise.
+func writeWindows(rep *requester.Report, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	format := "csv"
+	if strings.HasSuffix(name, ".json") {
+		format = "json"
+	}
+	if err := rep.PrintWindows(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mergeHeaders returns the headers of a request of a file, h, added to
+// those of the options and to the basic authentication.
+func mergeHeaders(header http.Header, username, password string, h http.Header) http.Header {
+	r := &http.Request{Header: make(http.Header)}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if username != "" || password != "" {
+		r.SetBasicAuth(username, password)
+	}
+	for k, v := range h {
+		r.Header[k] = v
+	}
+	return r.Header
+}
+
+// flagSet reports whether the named flag was set on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
 func errAndExit(msg string) {
@@ -277,6 +870,119 @@ func parseInputWithRegexp(input, regx string) ([]string, error) {
 	return matches, nil
 }
 
+// parseExpect builds the expectations given by the -expect options, or
+// returns nil if there are none.
+func parseExpect(status string, headers []string, body string, fields []string, size string) (*requester.Expect, error) {
+	if status == "" && len(headers) == 0 && body == "" && len(fields) == 0 && size == "" {
+		return nil, nil
+	}
+	e := &requester.Expect{}
+	if status != "" {
+		for _, v := range strings.Split(status, ",") {
+			v = strings.TrimSpace(v)
+			if len(v) == 3 && strings.HasSuffix(strings.ToLower(v), "xx") && v[0] >= '1' && v[0] <= '5' {
+				class := int(v[0]-'0') * 100
+				for code := class; code < class+100; code++ {
+					e.StatusCodes = append(e.StatusCodes, code)
+				}
+				continue
+			}
+			code, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid status code %q in -expect-status", v)
+			}
+			e.StatusCodes = append(e.StatusCodes, code)
+		}
+	}
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			return nil, fmt.Errorf("invalid -expect-header %q", h)
+		}
+		if e.Headers == nil {
+			e.Headers = make(map[string]*regexp.Regexp)
+		}
+		e.Headers[name] = nil
+		if len(parts) == 2 && strings.TrimSpace(parts[1]) != "" {
+			re, err := regexp.Compile(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid -expect-header %q: %v", h, err)
+			}
+			e.Headers[name] = re
+		}
+	}
+	if body != "" {
+		re, err := regexp.Compile(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -expect-body: %v", err)
+		}
+		e.Body = re
+	}
+	for _, f := range fields {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) == 1 {
+			e.JSON = append(e.JSON, requester.JSONCheck{Path: f, Exists: true})
+		} else {
+			e.JSON = append(e.JSON, requester.JSONCheck{Path: parts[0], Value: parts[1]})
+		}
+	}
+	if size != "" {
+		parts := strings.SplitN(size, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid -expect-size %q, want min:max", size)
+		}
+		var err error
+		if parts[0] != "" {
+			if e.MinSize, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid -expect-size %q", size)
+			}
+		}
+		if parts[1] != "" {
+			if e.MaxSize, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid -expect-size %q", size)
+			}
+		}
+	}
+	return e, nil
+}
+
+// parseStages parses a load profile such as "30s:10,1m:100/s".
+func parseStages(s string) ([]requester.Stage, error) {
+	var stages []requester.Stage
+	var rate bool
+	for i, v := range strings.Split(s, ",") {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid stage %q, want duration:target", v)
+		}
+		d, err := time.ParseDuration(parts[0])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid stage duration %q", parts[0])
+		}
+		target := parts[1]
+		isRate := strings.HasSuffix(target, "/s")
+		if i > 0 && isRate != rate {
+			return nil, fmt.Errorf("cannot mix worker and rate targets in -stages")
+		}
+		rate = isRate
+		stage := requester.Stage{Duration: d}
+		if isRate {
+			stage.Rate, err = strconv.ParseFloat(strings.TrimSuffix(target, "/s"), 64)
+			if err != nil || stage.Rate < 0 {
+				return nil, fmt.Errorf("invalid stage rate %q", target)
+			}
+		} else {
+			stage.C, err = strconv.Atoi(target)
+			if err != nil || stage.C < 0 {
+				return nil, fmt.Errorf("invalid stage target %q", target)
+			}
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
 type headerSlice []string
 
 func (h *headerSlice) String() string {
@@ -15,7 +15,12 @@
 package main
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/rakyll/hey/requester"
 )
 
 func TestParseValidHeaderFlag(t *testing.T) {
@@ -64,3 +69,137 @@ func TestParseAuthMetaCharacters(t *testing.T) {
 		t.Errorf("Auth header with a plus sign in the user name errored: %v", err)
 	}
 }
+
+func TestParseStages(t *testing.T) {
+	stages, err := parseStages("30s:10,1m:10,30s:0")
+	if err != nil {
+		t.Fatalf("parseStages errored: %v", err)
+	}
+	want := []requester.Stage{
+		{Duration: 30 * time.Second, C: 10},
+		{Duration: time.Minute, C: 10},
+		{Duration: 30 * time.Second, C: 0},
+	}
+	if !reflect.DeepEqual(stages, want) {
+		t.Errorf("got %v; want %v", stages, want)
+	}
+
+	stages, err = parseStages("1m:100/s")
+	if err != nil {
+		t.Fatalf("parseStages errored: %v", err)
+	}
+	if got, want := stages[0].Rate, 100.0; got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	for _, s := range []string{"30s", "30s:10,1m:100/s", "x:10", "30s:-1"} {
+		if _, err := parseStages(s); err == nil {
+			t.Errorf("parseStages(%q) did not error", s)
+		}
+	}
+}
+
+func TestParseExpect(t *testing.T) {
+	e, err := parseExpect("2xx,404", []string{"Content-Type: ^application/json", "X-Id"}, "ok", []string{"data.id", "status=ok"}, "10:")
+	if err != nil {
+		t.Fatalf("parseExpect failed: %v", err)
+	}
+	if len(e.StatusCodes) != 101 || e.StatusCodes[0] != 200 || e.StatusCodes[100] != 404 {
+		t.Errorf("Unexpected status codes: %v", e.StatusCodes)
+	}
+	if e.Headers["Content-Type"] == nil || e.Headers["X-Id"] != nil {
+		t.Errorf("Unexpected headers: %v", e.Headers)
+	}
+	if len(e.JSON) != 2 || !e.JSON[0].Exists || e.JSON[1].Value != "ok" {
+		t.Errorf("Unexpected JSON checks: %+v", e.JSON)
+	}
+	if e.MinSize != 10 || e.MaxSize != 0 {
+		t.Errorf("Unexpected size bounds: %d:%d", e.MinSize, e.MaxSize)
+	}
+	if e, _ := parseExpect("", nil, "", nil, ""); e != nil {
+		t.Errorf("Expected no expectations, found %+v", e)
+	}
+	for _, v := range []string{"abc", "6xx"} {
+		if _, err := parseExpect(v, nil, "", nil, ""); err == nil {
+			t.Errorf("Expected an error for -expect-status %q", v)
+		}
+	}
+}
+
+func TestParseCurl(t *testing.T) {
+	args, err := splitShell(`curl 'https://api.example.com/items?a=1' \
+  -H "Authorization: Bearer \"tok\"" -sSL -XPUT \
+  --data-raw $'{"name":"it\'s\\n"}' --compressed -u ann:secret --retry 3`)
+	if err != nil {
+		t.Fatalf("splitShell failed: %v", err)
+	}
+	cr, err := parseCurl(args)
+	if err != nil {
+		t.Fatalf("parseCurl failed: %v", err)
+	}
+	if cr.url != "https://api.example.com/items?a=1" || cr.method != "PUT" {
+		t.Errorf("Unexpected request %s %s", cr.method, cr.url)
+	}
+	if got := cr.header.Get("Authorization"); got != `Bearer "tok"` {
+		t.Errorf("Unexpected Authorization header %q", got)
+	}
+	if got := string(cr.body); got != "{\"name\":\"it's\\n\"}" {
+		t.Errorf("Unexpected body %q", got)
+	}
+	if got := cr.header.Get("Content-Type"); got != "application/x-www-form-urlencoded" {
+		t.Errorf("Unexpected Content-Type %q", got)
+	}
+	if !cr.compressed || !cr.location || cr.user != "ann:secret" {
+		t.Errorf("Unexpected options %+v", cr)
+	}
+	if !reflect.DeepEqual(cr.warnings, []string{"--retry"}) {
+		t.Errorf("Expected a warning about --retry, found %v", cr.warnings)
+	}
+
+	cr, err = parseCurl([]string{"curl", "-G", "localhost:8080/search", "-d", "q=1", "--data-urlencode", "t=a b"})
+	if err != nil {
+		t.Fatalf("parseCurl failed: %v", err)
+	}
+	if cr.url != "http://localhost:8080/search?q=1&t=a+b" || cr.method != "GET" || cr.body != nil {
+		t.Errorf("Unexpected request %s %s with body %q", cr.method, cr.url, cr.body)
+	}
+
+	cr, err = parseCurl([]string{"curl", "--json", `{"a":1}`, "http://localhost"})
+	if err != nil {
+		t.Fatalf("parseCurl failed: %v", err)
+	}
+	if cr.method != "POST" || cr.header.Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected request %s with Content-Type %q", cr.method, cr.header.Get("Content-Type"))
+	}
+
+	cr, err = parseCurl([]string{"curl", "--cacert", "ca.pem", "-E", "client.pem:pass", "--key", "client.key", "https://localhost"})
+	if err != nil {
+		t.Fatalf("parseCurl failed: %v", err)
+	}
+	if cr.cacert != "ca.pem" || cr.cert != "client.pem" || cr.key != "client.key" {
+		t.Errorf("Unexpected certificates %q, %q and %q", cr.cacert, cr.cert, cr.key)
+	}
+	if !reflect.DeepEqual(cr.warnings, []string{"-E password"}) {
+		t.Errorf("Expected a warning about the -E password, found %v", cr.warnings)
+	}
+
+	cr, err = parseCurl([]string{"curl", "https://api.example.com/items", "--retry-delay", "2", "-y", "5", "--max-redirs", "3"})
+	if err != nil {
+		t.Fatalf("parseCurl failed: %v", err)
+	}
+	if cr.url != "https://api.example.com/items" || !reflect.DeepEqual(cr.warnings, []string{"--retry-delay", "-y", "--max-redirs"}) {
+		t.Errorf("Unexpected URL %q and warnings %v", cr.url, cr.warnings)
+	}
+
+	// The argument of an unknown option after the URL is an error
+	// naming the option.
+	_, err = parseCurl([]string{"curl", "http://a", "--made-up", "2"})
+	if err == nil || !strings.Contains(err.Error(), "--made-up") || !strings.Contains(err.Error(), `"2"`) {
+		t.Errorf("Expected an error naming --made-up and its argument, found %v", err)
+	}
+	for _, args := range [][]string{{"curl", "-H"}, {"curl", "-s"}, {"curl", "http://a", "--made-up", "2"}, {"curl", "http://a", "--url", "http://b"}} {
+		if _, err := parseCurl(args); err == nil {
+			t.Errorf("Expected %q to fail", args)
+		}
+	}
+}
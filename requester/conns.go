@@ -0,0 +1,75 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// ConnectionReport counts the connections of a run, including those of
+// the warm-up.
+type ConnectionReport struct {
+	// Opened is the number of connections dialed, and Closed the number
+	// of them closed during the run, by either end.
+	Opened int64
+	Closed int64
+
+	// Reused is the number of requests sent on a connection that was
+	// already used.
+	Reused int64
+}
+
+// connCounts counts the connections of a run. It is updated atomically.
+type connCounts struct {
+	opened int64
+	closed int64
+	reused int64
+}
+
+var zeroDialer net.Dialer
+
+// dial dials a connection that is counted, as the transport would.
+func (c *connCounts) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := zeroDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.opened, 1)
+	return &countedConn{Conn: conn, counts: c}, nil
+}
+
+func (c *connCounts) snapshot() ConnectionReport {
+	return ConnectionReport{
+		Opened: atomic.LoadInt64(&c.opened),
+		Closed: atomic.LoadInt64(&c.closed),
+		Reused: atomic.LoadInt64(&c.reused),
+	}
+}
+
+// countedConn is a connection counted as closed the first time it is.
+type countedConn struct {
+	net.Conn
+	counts *connCounts
+	closed int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.counts.closed, 1)
+	}
+	return c.Conn.Close()
+}
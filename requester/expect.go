@@ -0,0 +1,132 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+)
+
+// Expect describes the responses a run expects. A response that does not
+// match is reported as a failure rather than as a success.
+type Expect struct {
+	// StatusCodes lists the allowed status codes. If empty, any status
+	// code is allowed.
+	StatusCodes []int
+
+	// Headers maps header names to a regexp their value must match. A
+	// nil regexp only requires the header to be present.
+	Headers map[string]*regexp.Regexp
+
+	// Body is a regexp the response body must match.
+	Body *regexp.Regexp
+
+	// JSON lists checks on the fields of a JSON response body.
+	JSON []JSONCheck
+
+	// MinSize and MaxSize bound the size of the response body in bytes.
+	// A zero MaxSize means no upper bound.
+	MinSize int64
+	MaxSize int64
+}
+
+// JSONCheck checks a field of a JSON response body.
+type JSONCheck struct {
+	// Path is the path of the field, such as "data.items.0.id".
+	Path string
+
+	// Value is the value the field must have. It is compared with the
+	// string value of string fields, and with the JSON encoding of any
+	// other field, such as 42, true or null.
+	Value string
+
+	// Exists only requires the field to be present, whatever its value.
+	Exists bool
+}
+
+// needsBody reports whether the body has to be read to check responses.
+func (e *Expect) needsBody() bool {
+	return e.Body != nil || len(e.JSON) > 0
+}
+
+// check reads and checks the response, and returns the reason it does
+// not match, or an empty string, along with the size of the body.
+func (e *Expect) check(resp *http.Response) (string, int64, error) {
+	var body []byte
+	var size int64
+	var err error
+	if e.needsBody() {
+		body, err = ioutil.ReadAll(resp.Body)
+		size = int64(len(body))
+	} else {
+		size, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	if err != nil {
+		return "", size, err
+	}
+	return e.match(resp, body, size), size, nil
+}
+
+// match returns why a response, whose body has the given size and was
+// read if needsBody, does not match, or "" if it does.
+func (e *Expect) match(resp *http.Response, body []byte, size int64) string {
+	if len(e.StatusCodes) > 0 {
+		var ok bool
+		for _, code := range e.StatusCodes {
+			if resp.StatusCode == code {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+		}
+	}
+	for name, re := range e.Headers {
+		values, ok := resp.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return fmt.Sprintf("missing header %s", name)
+		}
+		if re != nil && !re.MatchString(values[0]) {
+			return fmt.Sprintf("header %s does not match %s", name, re)
+		}
+	}
+	if size < e.MinSize || (e.MaxSize > 0 && size > e.MaxSize) {
+		return fmt.Sprintf("body size out of range [%d, %d]", e.MinSize, e.MaxSize)
+	}
+	if e.Body != nil && !e.Body.Match(body) {
+		return fmt.Sprintf("body does not match %s", e.Body)
+	}
+	if len(e.JSON) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return "body is not JSON"
+		}
+		for _, c := range e.JSON {
+			v, ok := lookupJSON(doc, c.Path)
+			if !ok {
+				return fmt.Sprintf("JSON field %s is missing", c.Path)
+			}
+			if !c.Exists && jsonString(v) != c.Value {
+				return fmt.Sprintf("JSON field %s is not %q", c.Path, c.Value)
+			}
+		}
+	}
+	return ""
+}
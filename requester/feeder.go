@@ -0,0 +1,148 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Feeder hands out rows of test data, such as user IDs or search terms,
+// to requests. Each row maps field names to values. It is safe for
+// concurrent use.
+type Feeder struct {
+	fields []string
+	rows   []map[string]string
+	mode   string
+	next   uint64
+}
+
+// NewFeeder returns a feeder of rows. The mode is how rows are handed out:
+// "sequential" cycles through them in order, "random" picks any of them at
+// random, and "unique" hands each of them out once, in order.
+func NewFeeder(rows []map[string]string, mode string) (*Feeder, error) {
+	switch mode {
+	case "":
+		mode = "sequential"
+	case "sequential", "random", "unique":
+	default:
+		return nil, fmt.Errorf("requester: unknown feeder mode %q", mode)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("requester: no data rows")
+	}
+	seen := make(map[string]bool)
+	f := &Feeder{rows: rows, mode: mode}
+	for _, row := range rows {
+		for k := range row {
+			if !seen[k] {
+				seen[k] = true
+				f.fields = append(f.fields, k)
+			}
+		}
+	}
+	sort.Strings(f.fields)
+	return f, nil
+}
+
+// LoadFeeder reads rows from a CSV file, whose first line names the
+// fields, or from a JSON Lines file, with one object per line, if the
+// file name ends in .jsonl, .ndjson or .json. See NewFeeder for the modes.
+func LoadFeeder(path, mode string) (*Feeder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []map[string]string
+	switch {
+	case strings.HasSuffix(path, ".jsonl"), strings.HasSuffix(path, ".ndjson"), strings.HasSuffix(path, ".json"):
+		s := bufio.NewScanner(f)
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; s.Scan(); line++ {
+			text := strings.TrimSpace(s.Text())
+			if text == "" {
+				continue
+			}
+			var obj map[string]interface{}
+			if err := json.Unmarshal([]byte(text), &obj); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			row := make(map[string]string, len(obj))
+			for k, v := range obj {
+				row[k] = jsonString(v)
+			}
+			rows = append(rows, row)
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("%s: missing header", path)
+		}
+		header := records[0]
+		for _, rec := range records[1:] {
+			row := make(map[string]string, len(header))
+			for i, name := range header {
+				row[name] = rec[i]
+			}
+			rows = append(rows, row)
+		}
+	}
+	feeder, err := NewFeeder(rows, mode)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return feeder, nil
+}
+
+// Fields returns the names of the fields of the rows, sorted.
+func (f *Feeder) Fields() []string {
+	return f.fields
+}
+
+// Next returns the next row, or false if the feeder is unique and all of
+// its rows have been handed out.
+func (f *Feeder) Next() (map[string]string, bool) {
+	if f.mode == "random" {
+		return f.rows[rand.Intn(len(f.rows))], true
+	}
+	i := atomic.AddUint64(&f.next, 1) - 1
+	if f.mode == "unique" {
+		if i >= uint64(len(f.rows)) {
+			return nil, false
+		}
+		return f.rows[i], true
+	}
+	return f.rows[i%uint64(len(f.rows))], true
+}
+
+func (f *Feeder) hasField(name string) bool {
+	i := sort.SearchStrings(f.fields, name)
+	return i < len(f.fields) && f.fields[i] == name
+}
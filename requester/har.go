@@ -0,0 +1,125 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// harFile is the part of a HAR (HTTP Archive) file used to replay it.
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// harSkipHeaders are the recorded headers not replayed, as the transport
+// sets them for the connection it sends the request on.
+var harSkipHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Accept-Encoding":   true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// LoadHAR reads the requests of a HAR file, such as a session recorded by
+// a browser, as targets in the order they were sent. Each target has the
+// method, URL, headers and body of a request, its Offset since the first
+// request, and is labeled with its number in the file, so the results
+// are reported per entry. Requests other than HTTP and HTTPS, such as
+// data URLs, are skipped.
+func LoadHAR(path string) ([]*Target, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	entries := har.Log.Entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+
+	var targets []*Target
+	var first time.Time
+	width := len(fmt.Sprint(len(entries)))
+	for i, e := range entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		}
+		if len(targets) == 0 {
+			first = e.StartedDateTime
+		}
+		t := &Target{
+			Method: e.Request.Method,
+			URL:    e.Request.URL,
+			Header: make(http.Header),
+			Offset: e.StartedDateTime.Sub(first),
+		}
+		t.Label = fmt.Sprintf("#%0*d %s %s", width, i+1, t.method(), t.URL)
+		for _, h := range e.Request.Headers {
+			// HTTP/2 pseudo-headers, such as :authority, start with a colon.
+			name := http.CanonicalHeaderKey(h.Name)
+			if strings.HasPrefix(name, ":") || harSkipHeaders[name] {
+				continue
+			}
+			t.Header.Add(name, h.Value)
+		}
+		if p := e.Request.PostData; p != nil && p.Text != "" {
+			t.Body = []byte(p.Text)
+			if t.Header.Get("Content-Type") == "" && p.MimeType != "" {
+				t.Header.Set("Content-Type", p.MimeType)
+			}
+		}
+		if _, err := http.NewRequest(t.method(), t.URL, nil); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s: no HTTP requests", path)
+	}
+	return targets, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Default number of significant decimal digits histograms keep.
+const defaultPrecision = 3
+
+// hdrUnit is the lowest duration histograms tell apart. Recording in
+// microseconds rather than nanoseconds takes ten fewer power of two
+// ranges, and so less memory, for the same largest value.
+const hdrUnit = time.Microsecond
+
+// hdrHistogram records durations in a fixed amount of memory, in the
+// manner of HdrHistogram. Values are kept to the given number of
+// significant decimal digits, and to the microsecond: each power of two
+// range of values is split into enough equal buckets for that precision,
+// so the memory it takes depends only on the precision and the largest
+// value recorded. With a largest value of a minute, that is about 140KB
+// at a precision of 3 and 10MB at 5.
+type hdrHistogram struct {
+	subBucketHalfCountMagnitude uint
+	subBucketHalfCount          int
+	subBucketMask               int64
+
+	counts []int64
+	total  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// newHDRHistogram returns a histogram that keeps precision significant
+// digits, between 1 and 5.
+func newHDRHistogram(precision int) *hdrHistogram {
+	if precision < 1 || precision > 5 {
+		precision = defaultPrecision
+	}
+	largest := 2 * math.Pow10(precision)
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(largest)))
+	subBucketCount := int64(1) << subBucketCountMagnitude
+	return &hdrHistogram{
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+		subBucketHalfCount:          int(subBucketCount / 2),
+		subBucketMask:               subBucketCount - 1,
+	}
+}
+
+func (h *hdrHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := h.countsIndex(int64(d / hdrUnit))
+	if i >= len(h.counts) {
+		// Grow by whole power of two ranges.
+		n := (i>>h.subBucketHalfCountMagnitude + 1) << h.subBucketHalfCountMagnitude
+		counts := make([]int64, n)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+	if h.total == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.total++
+	h.sum += d
+}
+
+// reset clears the histogram, keeping the memory it took.
+func (h *hdrHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.total, h.sum, h.min, h.max = 0, 0, 0, 0
+}
+
+func (h *hdrHistogram) countsIndex(v int64) int {
+	bucket := 64 - bits.LeadingZeros64(uint64(v|h.subBucketMask)) - int(h.subBucketHalfCountMagnitude+1)
+	subBucket := int(v >> uint(bucket))
+	return (bucket+1)<<h.subBucketHalfCountMagnitude + subBucket - h.subBucketHalfCount
+}
+
+// bounds returns the lowest and highest values recorded at index i.
+func (h *hdrHistogram) bounds(i int) (lo, hi time.Duration) {
+	bucket := i>>h.subBucketHalfCountMagnitude - 1
+	subBucket := i&(h.subBucketHalfCount-1) + h.subBucketHalfCount
+	if bucket < 0 {
+		subBucket -= h.subBucketHalfCount
+		bucket = 0
+	}
+	l := int64(subBucket) << uint(bucket)
+	return time.Duration(l) * hdrUnit, time.Duration(l+int64(1)<<uint(bucket))*hdrUnit - 1
+}
+
+// mean returns the exact average of the recorded values.
+func (h *hdrHistogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.total)
+}
+
+// percentile returns the value below which p percent of the recorded
+// values fall.
+func (h *hdrHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	want := int64(math.Ceil(p / 100 * float64(h.total)))
+	if want < 1 {
+		want = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= want {
+			_, hi := h.bounds(i)
+			return h.clamp(hi)
+		}
+	}
+	return h.max
+}
+
+func (h *hdrHistogram) clamp(d time.Duration) time.Duration {
+	if d < h.min {
+		return h.min
+	}
+	if d > h.max {
+		return h.max
+	}
+	return d
+}
+
+// latencies returns the latency distribution, in seconds.
+func (h *hdrHistogram) latencies() []LatencyDistribution {
+	if h.total == 0 {
+		return nil
+	}
+	res := make([]LatencyDistribution, len(pctls))
+	for i, p := range pctls {
+		res[i] = LatencyDistribution{Percentage: int(p), Percentile: p, Latency: h.percentile(p).Seconds()}
+	}
+	return res
+}
+
+// buckets splits the range between the fastest and the slowest values
+// into ten equal buckets, in seconds, as the response time histogram of
+// the summary always has.
+func (h *hdrHistogram) buckets() []Bucket {
+	if h.total == 0 {
+		return nil
+	}
+	fastest, slowest := h.min.Seconds(), h.max.Seconds()
+	bc := 10
+	res := make([]Bucket, bc+1)
+	bs := (slowest - fastest) / float64(bc)
+	for i := 0; i < bc; i++ {
+		res[i].Mark = fastest + bs*float64(i)
+	}
+	res[bc].Mark = slowest
+	bi := 0
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		lo, hi := h.bounds(i)
+		v := h.clamp(lo + (hi-lo)/2).Seconds()
+		for bi < bc && v > res[bi].Mark {
+			bi++
+		}
+		res[bi].Count += int(c)
+	}
+	for i := range res {
+		res[i].Frequency = float64(res[i].Count) / float64(h.total)
+	}
+	return res
+}
@@ -0,0 +1,394 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// JSONSchemaVersion is the version of the JSON summary format. It is
+// incremented whenever a field is removed or changes meaning; fields may
+// be added without changing it.
+const JSONSchemaVersion = 1
+
+// JSONReport is the JSON summary of a run. All durations are in seconds.
+type JSONReport struct {
+	SchemaVersion int        `json:"schema_version"`
+	Config        JSONConfig `json:"config"`
+
+	Total     float64 `json:"total"`
+	Slowest   float64 `json:"slowest"`
+	Fastest   float64 `json:"fastest"`
+	Average   float64 `json:"average"`
+	Rps       float64 `json:"rps"`
+	TargetRps float64 `json:"target_rps,omitempty"`
+	NumRes    int64   `json:"num_res"`
+	Cancelled int64   `json:"cancelled"`
+	SizeTotal int64   `json:"size_total"`
+	SizeReq   int64   `json:"size_req"`
+
+	LatencyDistribution []JSONPercentile `json:"latency_distribution"`
+	Histogram           []JSONBucket     `json:"histogram"`
+	Phases              JSONPhases       `json:"phases"`
+
+	StatusCodeDist map[string]int `json:"status_code_dist"`
+	ErrorDist      map[string]int `json:"error_dist"`
+	FailureDist    map[string]int `json:"failure_dist"`
+
+	WarmUp   *JSONGroup  `json:"warm_up,omitempty"`
+	Scenario *JSONGroup  `json:"scenario,omitempty"`
+	Stages   []JSONGroup `json:"stages,omitempty"`
+	Labels   []JSONGroup `json:"labels,omitempty"`
+
+	Windows     []JSONWindow `json:"windows,omitempty"`
+	WindowsLate int64        `json:"windows_late,omitempty"`
+
+	Pacing *JSONPacing `json:"pacing,omitempty"`
+
+	Connections JSONConnections `json:"connections"`
+
+	// Passed is false if any of the thresholds failed.
+	Passed     bool            `json:"passed"`
+	Thresholds []JSONThreshold `json:"thresholds,omitempty"`
+}
+
+// JSONConfig is the configuration of the run.
+type JSONConfig struct {
+	Method             string      `json:"method,omitempty"`
+	URL                string      `json:"url,omitempty"`
+	Targets            int         `json:"targets,omitempty"`
+	N                  int         `json:"n"`
+	C                  int         `json:"c"`
+	QPS                float64     `json:"qps,omitempty"`
+	GlobalQPS          bool        `json:"global_qps,omitempty"`
+	Rate               float64     `json:"rate,omitempty"`
+	Stages             []JSONStage `json:"stages,omitempty"`
+	WarmUp             float64     `json:"warm_up,omitempty"`
+	WarmUpRequests     int         `json:"warm_up_requests,omitempty"`
+	ReplaySpeed        float64     `json:"replay_speed,omitempty"`
+	Timeout            int         `json:"timeout"`
+	H2                 bool        `json:"h2"`
+	DisableCompression bool        `json:"disable_compression"`
+	DisableKeepAlives  bool        `json:"disable_keepalives"`
+	DisableRedirects   bool        `json:"disable_redirects"`
+	CookieJars         bool        `json:"cookie_jars,omitempty"`
+	WorkerConnections  bool        `json:"worker_connections,omitempty"`
+	Connections        int         `json:"connections,omitempty"`
+	MaxConnsPerHost    int         `json:"max_conns_per_host,omitempty"`
+	Proxy              string      `json:"proxy,omitempty"`
+}
+
+// JSONStage is a stage of the load profile.
+type JSONStage struct {
+	Duration float64 `json:"duration"`
+	C        int     `json:"c,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+}
+
+// JSONPercentile is the latency under which Percentage percent of the
+// requests completed.
+type JSONPercentile struct {
+	Percentage float64 `json:"percentage"`
+	Latency    float64 `json:"latency"`
+}
+
+// JSONBucket is a bucket of the response time histogram.
+type JSONBucket struct {
+	Mark      float64 `json:"mark"`
+	Count     int     `json:"count"`
+	Frequency float64 `json:"frequency"`
+}
+
+// JSONPhase summarizes the time spent in one phase of the requests.
+type JSONPhase struct {
+	Average float64 `json:"average"`
+	Fastest float64 `json:"fastest"`
+	Slowest float64 `json:"slowest"`
+
+	LatencyDistribution []JSONPercentile `json:"latency_distribution"`
+}
+
+// JSONPhases holds the time spent in each phase of the requests.
+type JSONPhases struct {
+	Conn     JSONPhase `json:"conn"`      // DNS lookup and dial
+	DNS      JSONPhase `json:"dns"`       // DNS lookup
+	ReqWrite JSONPhase `json:"req_write"` // writing the request
+	RespWait JSONPhase `json:"resp_wait"` // waiting for the first byte
+	RespRead JSONPhase `json:"resp_read"` // reading the response
+}
+
+// JSONWindow summarizes the results of the requests started in a time
+// window of the run. Its "total" is the length of the window.
+type JSONWindow struct {
+	Start float64 `json:"start"` // since the start of the run
+	JSONGroup
+}
+
+func newJSONWindow(w WindowReport) JSONWindow {
+	return JSONWindow{Start: w.Start.Seconds(), JSONGroup: newJSONGroup(w.GroupReport)}
+}
+
+// JSONThreshold is the outcome of a threshold. Actual is null if the
+// metric has no value, such as a latency when no request succeeded.
+type JSONThreshold struct {
+	Threshold string   `json:"threshold"`
+	Actual    *float64 `json:"actual"`
+	Pass      bool     `json:"pass"`
+}
+
+// JSONPacing compares when replayed requests were sent with their
+// schedule.
+type JSONPacing struct {
+	Speed      float64 `json:"speed"`
+	Scheduled  float64 `json:"scheduled"`
+	Actual     float64 `json:"actual"`
+	AverageLag float64 `json:"average_lag"`
+	MaxLag     float64 `json:"max_lag"`
+	Late       int64   `json:"late"`
+}
+
+// JSONConnections counts the connections of the run.
+type JSONConnections struct {
+	Opened int64 `json:"opened"`
+	Reused int64 `json:"reused"`
+	Closed int64 `json:"closed"`
+}
+
+// JSONGroup summarizes the results of a stage or a label.
+type JSONGroup struct {
+	Name    string  `json:"name"`
+	Total   float64 `json:"total"`
+	NumRes  int64   `json:"num_res"`
+	Rps     float64 `json:"rps"`
+	Average float64 `json:"average"`
+	Fastest float64 `json:"fastest"`
+	Slowest float64 `json:"slowest"`
+
+	SizeTotal int64 `json:"size_total"`
+
+	LatencyDistribution []JSONPercentile `json:"latency_distribution"`
+	Histogram           []JSONBucket     `json:"histogram"`
+
+	StatusCodeDist map[string]int `json:"status_code_dist"`
+	ErrorDist      map[string]int `json:"error_dist"`
+	FailureDist    map[string]int `json:"failure_dist"`
+}
+
+// NewJSONReport converts r to the JSON summary format.
+func NewJSONReport(r *Report) *JSONReport {
+	j := &JSONReport{
+		SchemaVersion: JSONSchemaVersion,
+		Config:        newJSONConfig(r.Config),
+		Total:         r.Total.Seconds(),
+		Slowest:       r.Slowest,
+		Fastest:       r.Fastest,
+		Average:       r.Average,
+		Rps:           r.Rps,
+		TargetRps:     r.TargetRps,
+		NumRes:        r.NumRes,
+		Cancelled:     r.Cancelled,
+		SizeTotal:     r.SizeTotal,
+		SizeReq:       r.SizeReq,
+
+		LatencyDistribution: jsonPercentiles(r.LatencyDistribution),
+		Histogram:           jsonBuckets(r.Histogram),
+		// The *Max fields of Report hold the fastest times and the
+		// *Min fields the slowest ones.
+		Phases: JSONPhases{
+			Conn:     JSONPhase{r.AvgConn, r.ConnMax, r.ConnMin, jsonPercentiles(r.ConnDistribution)},
+			DNS:      JSONPhase{r.AvgDNS, r.DnsMax, r.DnsMin, jsonPercentiles(r.DNSDistribution)},
+			ReqWrite: JSONPhase{r.AvgReq, r.ReqMax, r.ReqMin, jsonPercentiles(r.ReqDistribution)},
+			RespWait: JSONPhase{r.AvgDelay, r.DelayMax, r.DelayMin, jsonPercentiles(r.DelayDistribution)},
+			RespRead: JSONPhase{r.AvgRes, r.ResMax, r.ResMin, jsonPercentiles(r.ResDistribution)},
+		},
+
+		StatusCodeDist: jsonStatusCodes(r.StatusCodeDist),
+		ErrorDist:      jsonErrors(r.ErrorDist),
+		FailureDist:    jsonErrors(r.FailureDist),
+
+		Connections: JSONConnections{r.Connections.Opened, r.Connections.Reused, r.Connections.Closed},
+	}
+	if r.WarmUp != nil {
+		g := newJSONGroup(*r.WarmUp)
+		j.WarmUp = &g
+	}
+	if r.Scenario != nil {
+		g := newJSONGroup(*r.Scenario)
+		j.Scenario = &g
+	}
+	for _, g := range r.Stages {
+		j.Stages = append(j.Stages, newJSONGroup(g))
+	}
+	for _, g := range r.Labels {
+		j.Labels = append(j.Labels, newJSONGroup(g))
+	}
+	for _, w := range r.Windows {
+		j.Windows = append(j.Windows, newJSONWindow(w))
+	}
+	j.WindowsLate = r.WindowsLate
+	if p := r.Pacing; p != nil {
+		j.Pacing = &JSONPacing{p.Speed, p.Scheduled.Seconds(), p.Actual.Seconds(), p.AverageLag, p.MaxLag, p.Late}
+	}
+	j.Passed = r.Passed()
+	for _, t := range r.Thresholds {
+		jt := JSONThreshold{Threshold: t.Threshold.String(), Pass: t.Pass}
+		if !math.IsNaN(t.Actual) {
+			actual := t.Actual
+			jt.Actual = &actual
+		}
+		j.Thresholds = append(j.Thresholds, jt)
+	}
+	return j
+}
+
+func newJSONConfig(c RunConfig) JSONConfig {
+	j := JSONConfig{
+		Method:             c.Method,
+		URL:                c.URL,
+		Targets:            c.Targets,
+		N:                  c.N,
+		C:                  c.C,
+		QPS:                c.QPS,
+		GlobalQPS:          c.GlobalQPS,
+		Rate:               c.Rate,
+		WarmUp:             c.WarmUp.Seconds(),
+		WarmUpRequests:     c.WarmUpRequests,
+		ReplaySpeed:        c.ReplaySpeed,
+		Timeout:            c.Timeout,
+		H2:                 c.H2,
+		DisableCompression: c.DisableCompression,
+		DisableKeepAlives:  c.DisableKeepAlives,
+		DisableRedirects:   c.DisableRedirects,
+		CookieJars:         c.CookieJars,
+		WorkerConnections:  c.WorkerConnections,
+		Connections:        c.Connections,
+		MaxConnsPerHost:    c.MaxConnsPerHost,
+		Proxy:              c.Proxy,
+	}
+	for _, s := range c.Stages {
+		j.Stages = append(j.Stages, JSONStage{Duration: s.Duration.Seconds(), C: s.C, Rate: s.Rate})
+	}
+	return j
+}
+
+func newJSONGroup(g GroupReport) JSONGroup {
+	return JSONGroup{
+		Name:                g.Name,
+		Total:               g.Total.Seconds(),
+		NumRes:              g.NumRes,
+		Rps:                 g.Rps,
+		Average:             g.Average,
+		Fastest:             g.Fastest,
+		Slowest:             g.Slowest,
+		SizeTotal:           g.SizeTotal,
+		LatencyDistribution: jsonPercentiles(g.LatencyDistribution),
+		Histogram:           jsonBuckets(g.Histogram),
+		StatusCodeDist:      jsonStatusCodes(g.StatusCodeDist),
+		ErrorDist:           jsonErrors(g.ErrorDist),
+		FailureDist:         jsonErrors(g.FailureDist),
+	}
+}
+
+func jsonPercentiles(lats []LatencyDistribution) []JSONPercentile {
+	res := []JSONPercentile{}
+	for _, l := range lats {
+		// Percentiles that could not be computed are left zero.
+		if l.Percentile > 0 {
+			res = append(res, JSONPercentile{l.Percentile, l.Latency})
+		}
+	}
+	return res
+}
+
+func jsonBuckets(buckets []Bucket) []JSONBucket {
+	res := []JSONBucket{}
+	for _, b := range buckets {
+		res = append(res, JSONBucket{b.Mark, b.Count, b.Frequency})
+	}
+	return res
+}
+
+func jsonStatusCodes(dist map[int]int) map[string]int {
+	res := make(map[string]int, len(dist))
+	for code, n := range dist {
+		res[strconv.Itoa(code)] = n
+	}
+	return res
+}
+
+func jsonErrors(dist map[string]int) map[string]int {
+	if dist == nil {
+		return map[string]int{}
+	}
+	return dist
+}
+
+// JSONResult is a line of the result log, describing a single request.
+// Durations are in seconds.
+type JSONResult struct {
+	Time     time.Time `json:"time"`   // when the request was started
+	Offset   float64   `json:"offset"` // since the start of the run
+	URL      string    `json:"url,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Duration float64   `json:"duration"`
+	Conn     float64   `json:"conn"`
+	DNS      float64   `json:"dns"`
+	ReqWrite float64   `json:"req_write"`
+	RespWait float64   `json:"resp_wait"`
+	RespRead float64   `json:"resp_read"`
+	Bytes    int64     `json:"bytes"` // of the body read
+	Error    string    `json:"error,omitempty"`
+	Failure  string    `json:"failure,omitempty"` // why the response did not match expectations
+
+	// Cancelled is set if the run was stopped while the request was in
+	// flight.
+	Cancelled bool `json:"cancelled,omitempty"`
+
+	// WarmUp is set if the request was sent during the warm-up.
+	WarmUp bool `json:"warm_up,omitempty"`
+
+	// Scenario is set if the line describes a whole run of the scenario
+	// rather than a single request.
+	Scenario bool `json:"scenario,omitempty"`
+}
+
+func newJSONResult(res *result, start time.Time) *JSONResult {
+	j := &JSONResult{
+		Time:     start.Add(res.offset),
+		Offset:   res.offset.Seconds(),
+		URL:      res.url,
+		Label:    res.label,
+		Status:   res.statusCode,
+		Duration: res.duration.Seconds(),
+		Conn:     res.connDuration.Seconds(),
+		DNS:      res.dnsDuration.Seconds(),
+		ReqWrite: res.reqDuration.Seconds(),
+		RespWait: res.delayDuration.Seconds(),
+		RespRead: res.resDuration.Seconds(),
+		Bytes:    res.contentLength,
+		Failure:  res.failure,
+
+		Cancelled: res.cancelled,
+		WarmUp:    res.warmUp,
+		Scenario:  res.scenario,
+	}
+	if res.err != nil {
+		j.Error = res.err.Error()
+	}
+	return j
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket shared by all workers. Tokens are added at a
+// fixed rate and the bucket holds at most one, so requests are spread
+// evenly instead of being sent in bursts.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Duration // time the next token becomes available
+}
+
+func newLimiter(qps float64) *limiter {
+	return &limiter{interval: time.Duration(float64(time.Second) / qps)}
+}
+
+// wait blocks until a token is available and takes it, and reports
+// whether it did so before stop was closed.
+func (l *limiter) wait(stop <-chan struct{}) bool {
+	l.mu.Lock()
+	t := now()
+	if l.next < t {
+		l.next = t
+	}
+	at := l.next
+	l.next += l.interval
+	l.mu.Unlock()
+
+	if d := at - t; d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
@@ -13,16 +13,30 @@
 // limitations under the License.
 
 /*
-Hey supports two output formats: summary and CSV
+Hey supports three output formats: summary, CSV and JSON
 
 The summary output presents a number of statistics about the requests in a
 human-readable format, including:
-- general statistics: requests/second, total runtime, and average, fastest, and slowest requests.
+- general statistics: requests/second, the target rate if rate limited, total runtime, and average, fastest, and slowest requests.
+- the number of requests cancelled because the run was stopped while they were in flight, if any. They are left out of the other statistics.
+- if requests were replayed, how late they were sent compared with their schedule.
 - a response time histogram.
 - a percentile latency distribution.
-- statistics (average, fastest, slowest) on the stages of the requests.
+- statistics (average, fastest, slowest, and percentiles) on the stages of the requests.
+- if the run had a warm-up, the same statistics for the warm-up, which are left out of the others.
+- if the run had a scenario, the same statistics for its whole runs, without think times.
+- if the run followed a load profile, the same statistics for each of its stages.
+- if requests were labeled, such as by target, the same statistics with a histogram and status code and error distributions for each label.
+- if the run had thresholds, whether each of them passed, and the overall result.
 
-The comma-separated CSV format is proceeded by a header, and consists of the following columns:
+If responses are checked against expectations, the ones that do not match are
+counted as failures by reason, and left out of the other statistics.
+
+Latencies are recorded in histograms that keep a fixed number of significant
+digits, 3 by default, so that percentiles are accurate however long the run.
+
+The comma-separated CSV format is proceeded by a header, and consists of the following columns,
+for up to the first million successful requests:
 1. response-time:	Total time taken for request (in seconds)
 2. DNS+dialup:		Time taken to establish the TCP connection (in seconds)
 3. DNS:				Time taken to do the DNS lookup (in seconds)
@@ -31,6 +45,44 @@ The comma-separated CSV format is proceeded by a header, and consists of the fol
 6. Response-read:	Time taken to read full response (in seconds)
 7. status-code:		HTTP status code of the response (e.g. 200)
 8. offset:			The time since the start of the benchmark when the request was started. (in seconds)
+9. label:			The label of the request, such as the target it was made from, if any.
+
+The JSON format is a single object holding the whole summary, described by
+JSONReport. Its "schema_version" field is JSONSchemaVersion, which changes
+whenever a field is removed or changes meaning. All durations are in seconds.
+
+	{
+	  "schema_version": 1,
+	  "config": {"method": "GET", "url": "http://localhost", "n": 200, "c": 50, "timeout": 20, ...},
+	  "total": 1.2, "slowest": 0.5, "fastest": 0.01, "average": 0.1, "rps": 166.6,
+	  "target_rps": 0, "num_res": 200, "cancelled": 0, "size_total": 2000, "size_req": 10,
+	  "latency_distribution": [{"percentage": 10, "latency": 0.02}, ...],
+	  "histogram": [{"mark": 0.01, "count": 12, "frequency": 0.06}, ...],
+	  "phases": {"conn": {"average": 0.01, "fastest": 0, "slowest": 0.1}, "dns": {...},
+	             "req_write": {...}, "resp_wait": {...}, "resp_read": {...}},
+	  "status_code_dist": {"200": 200},
+	  "error_dist": {},
+	  "warm_up": {...},
+	  "scenario": {...},
+	  "stages": [...],
+	  "labels": [...],
+	  "windows": [...],
+	  "pacing": {"speed": 1, "scheduled": 60, "actual": 60.01, "average_lag": 0.001, "max_lag": 0.02, "late": 3},
+	  "connections": {"opened": 50, "reused": 150, "closed": 0},
+	  "passed": true,
+	  "thresholds": [{"threshold": "p95 < 0.2", "actual": 0.15, "pass": true}, ...]
+	}
+
+"stages" and "labels" are only present if the run had a load profile or
+labeled requests. Each of their entries has a "name", "total", "num_res",
+"rps", "average", "fastest", "slowest", "size_total", "latency_distribution",
+"histogram", "status_code_dist" and "error_dist", as have "warm_up", which is
+only present if the run had a warm-up, and "scenario", which is only present if
+it had a scenario. "windows" is only present if
+the results were split into time windows, and its entries have a "start" as
+well; "windows_late" counts the results that came after their window was
+closed, if any. "pacing" is only present if requests were replayed. "thresholds" is only present
+if the run had thresholds, and "passed" is false if any of them failed.
 */
 package requester
 
@@ -38,26 +90,64 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
 	"text/template"
 )
 
-func newTemplate(output string) *template.Template {
+func newTemplate(output string) (*template.Template, error) {
 	outputTmpl := output
 	switch outputTmpl {
 	case "":
 		outputTmpl = defaultTmpl
 	case "csv":
 		outputTmpl = csvTmpl
+	default:
+		// Custom templates were once printed as format strings, so
+		// keep writing a literal % as %% in them.
+		outputTmpl = strings.Replace(output, "%%", "%", -1)
+	}
+	t, err := template.New("tmpl").Funcs(tmplFuncMap).Parse(outputTmpl)
+	if err != nil {
+		return nil, err
+	}
+	return t.Parse(groupTmpl)
+}
+
+// Print writes the report to w in the given output format: "" for the
+// summary, "csv" for the raw samples, "json" for JSONReport, or else a
+// text/template executed with the report. The CSV format and most custom
+// templates need the raw samples, see Work.RawSamples.
+func (r *Report) Print(w io.Writer, output string) error {
+	if output == "json" {
+		b, err := json.MarshalIndent(NewJSONReport(r), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	t, err := newTemplate(output)
+	if err != nil {
+		return err
 	}
-	return template.Must(template.New("tmpl").Funcs(tmplFuncMap).Parse(outputTmpl))
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, r); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err = w.Write(buf.Bytes())
+	return err
 }
 
 var tmplFuncMap = template.FuncMap{
 	"formatNumber":    formatNumber,
 	"formatNumberInt": formatNumberInt,
 	"histogram":       histogram,
+	"achieved":        achieved,
 	"jsonify":         jsonify,
+	"csvField":        csvField,
+	"percentile":      percentile,
 }
 
 func jsonify(v interface{}) string {
@@ -65,6 +155,24 @@ func jsonify(v interface{}) string {
 	return string(d)
 }
 
+// percentile returns the latency of the pth percentile in dist, or zero.
+func percentile(dist []LatencyDistribution, p float64) float64 {
+	for _, d := range dist {
+		if d.Percentile == p {
+			return d.Latency
+		}
+	}
+	return 0
+}
+
+// csvField quotes s for use as a CSV field, if needed.
+func csvField(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
 func formatNumber(duration float64) string {
 	return fmt.Sprintf("%4.4f", duration)
 }
@@ -73,6 +181,11 @@ func formatNumberInt(duration int) string {
 	return fmt.Sprintf("%d", duration)
 }
 
+// achieved formats the achieved rate as a percentage of the target rate.
+func achieved(rps, target float64) string {
+	return fmt.Sprintf("%.1f", rps/target*100)
+}
+
 func histogram(buckets []Bucket) string {
 	max := 0
 	for _, b := range buckets {
@@ -99,16 +212,25 @@ Summary:
   Slowest:	{{ formatNumber .Slowest }} secs
   Fastest:	{{ formatNumber .Fastest }} secs
   Average:	{{ formatNumber .Average }} secs
-  Requests/sec:	{{ formatNumber .Rps }}
+  Requests/sec:	{{ formatNumber .Rps }}{{ if gt .TargetRps 0.0 }}
+  Target rate:	{{ formatNumber .TargetRps }} ({{ achieved .Rps .TargetRps }}% achieved){{ end }}{{ if gt .Cancelled 0 }}
+  Cancelled:	{{ .Cancelled }} requests in flight at stop{{ end }}
   {{ if gt .SizeTotal 0 }}
   Total data:	{{ .SizeTotal }} bytes
   Size/request:	{{ .SizeReq }} bytes{{ end }}
-
+{{ if .Pacing }}
+Replay pacing:
+  Speed:	{{ .Pacing.Speed }}x
+  Scheduled:	{{ formatNumber .Pacing.Scheduled.Seconds }} secs
+  Actual:	{{ formatNumber .Pacing.Actual.Seconds }} secs
+  Lag (average, slowest):	{{ formatNumber .Pacing.AverageLag }} secs, {{ formatNumber .Pacing.MaxLag }} secs
+  Late:	{{ .Pacing.Late }} requests more than 10ms late
+{{ end }}
 Response time histogram:
 {{ histogram .Histogram }}
 
 Latency distribution:{{ range .LatencyDistribution }}
-  {{ .Percentage }}%% in {{ formatNumber .Latency }} secs{{ end }}
+  {{ .Percentile }}% in {{ formatNumber .Latency }} secs{{ end }}
 
 Details (average, fastest, slowest):
   DNS+dialup:	{{ formatNumber .AvgConn }} secs, {{ formatNumber .ConnMax }} secs, {{ formatNumber .ConnMin }} secs
@@ -117,12 +239,53 @@ Details (average, fastest, slowest):
   resp wait:	{{ formatNumber .AvgDelay }} secs, {{ formatNumber .DelayMax }} secs, {{ formatNumber .DelayMin }} secs
   resp read:	{{ formatNumber .AvgRes }} secs, {{ formatNumber .ResMax }} secs, {{ formatNumber .ResMin }} secs
 
+Details (50%, 99%, 99.9% in):
+  DNS+dialup:	{{ template "pctls" .ConnDistribution }}
+  DNS-lookup:	{{ template "pctls" .DNSDistribution }}
+  req write:	{{ template "pctls" .ReqDistribution }}
+  resp wait:	{{ template "pctls" .DelayDistribution }}
+  resp read:	{{ template "pctls" .ResDistribution }}
+
+Connections:
+  Opened:	{{ .Connections.Opened }}
+  Reused:	{{ .Connections.Reused }} requests
+  Closed:	{{ .Connections.Closed }}
+
 Status code distribution:{{ range $code, $num := .StatusCodeDist }}
   [{{ $code }}]	{{ $num }} responses{{ end }}
 
 {{ if gt (len .ErrorDist) 0 }}Error distribution:{{ range $err, $num := .ErrorDist }}
   [{{ $num }}]	{{ $err }}{{ end }}{{ end }}
-`
-	csvTmpl = `{{ $connLats := .ConnLats }}{{ $dnsLats := .DnsLats }}{{ $dnsLats := .DnsLats }}{{ $reqLats := .ReqLats }}{{ $delayLats := .DelayLats }}{{ $resLats := .ResLats }}{{ $statusCodeLats := .StatusCodes }}{{ $offsets := .Offsets}}response-time,DNS+dialup,DNS,Request-write,Response-delay,Response-read,status-code,offset{{ range $i, $v := .Lats }}
-{{ formatNumber $v }},{{ formatNumber (index $connLats $i) }},{{ formatNumber (index $dnsLats $i) }},{{ formatNumber (index $reqLats $i) }},{{ formatNumber (index $delayLats $i) }},{{ formatNumber (index $resLats $i) }},{{ formatNumberInt (index $statusCodeLats $i) }},{{ formatNumber (index $offsets $i) }}{{ end }}`
+{{ if gt (len .FailureDist) 0 }}
+Failure distribution:{{ range $reason, $num := .FailureDist }}
+  [{{ $num }}]	{{ $reason }}{{ end }}
+{{ end }}{{ if .WarmUp }}
+{{ template "group" .WarmUp }}{{ end }}{{ if .Scenario }}
+{{ template "group" .Scenario }}{{ end }}{{ range .Stages }}
+{{ template "group" . }}{{ end }}{{ range .Labels }}
+{{ template "group" . }}{{ end }}{{ if gt (len .Thresholds) 0 }}
+Thresholds:{{ range .Thresholds }}
+  [{{ if .Pass }}PASS{{ else }}FAIL{{ end }}]	{{ .Threshold }} (actual {{ formatNumber .Actual }}){{ end }}
+
+Result: {{ if .Passed }}PASS{{ else }}FAIL{{ end }}
+{{ end }}`
+	groupTmpl = `{{ define "pctls" }}{{ formatNumber (percentile . 50.0) }} secs, {{ formatNumber (percentile . 99.0) }} secs, {{ formatNumber (percentile . 99.9) }} secs{{ end }}{{ define "group" }}{{ .Name }}:
+  Total:	{{ formatNumber .Total.Seconds }} secs
+  Requests:	{{ .NumRes }}
+  Requests/sec:	{{ formatNumber .Rps }}
+  Slowest:	{{ formatNumber .Slowest }} secs
+  Fastest:	{{ formatNumber .Fastest }} secs
+  Average:	{{ formatNumber .Average }} secs
+  Response time histogram:
+{{ histogram .Histogram }}  Latency distribution:{{ range .LatencyDistribution }}
+    {{ .Percentile }}% in {{ formatNumber .Latency }} secs{{ end }}
+  Status code distribution:{{ range $code, $num := .StatusCodeDist }}
+    [{{ $code }}]	{{ $num }} responses{{ end }}
+{{ if gt (len .ErrorDist) 0 }}  Error distribution:{{ range $err, $num := .ErrorDist }}
+    [{{ $num }}]	{{ $err }}{{ end }}
+{{ end }}{{ if gt (len .FailureDist) 0 }}  Failure distribution:{{ range $reason, $num := .FailureDist }}
+    [{{ $num }}]	{{ $reason }}{{ end }}
+{{ end }}{{ end }}`
+	csvTmpl = `{{ $connLats := .ConnLats }}{{ $dnsLats := .DnsLats }}{{ $dnsLats := .DnsLats }}{{ $reqLats := .ReqLats }}{{ $delayLats := .DelayLats }}{{ $resLats := .ResLats }}{{ $statusCodeLats := .StatusCodes }}{{ $offsets := .Offsets}}{{ $labels := .ResultLabels }}response-time,DNS+dialup,DNS,Request-write,Response-delay,Response-read,status-code,offset,label{{ range $i, $v := .Lats }}
+{{ formatNumber $v }},{{ formatNumber (index $connLats $i) }},{{ formatNumber (index $dnsLats $i) }},{{ formatNumber (index $reqLats $i) }},{{ formatNumber (index $delayLats $i) }},{{ formatNumber (index $resLats $i) }},{{ formatNumberInt (index $statusCodeLats $i) }},{{ formatNumber (index $offsets $i) }},{{ csvField (index $labels $i) }}{{ end }}`
 )
@@ -0,0 +1,99 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Default interval between progress updates.
+const defaultProgressInterval = time.Second
+
+// progress writes interim statistics while a run goes. Throughput and
+// latencies are those of the last interval; counts are since the start.
+type progress struct {
+	w        io.Writer
+	interval time.Duration
+	lines    bool // write each update on a new line instead of in place
+
+	last   time.Time
+	window *hdrHistogram
+	n      int64 // results in the window
+	total  int64 // results since the start
+	errors int64 // errors and failures since the start
+}
+
+func newProgress(w io.Writer, interval time.Duration, lines bool, precision int) *progress {
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	return &progress{
+		w:        w,
+		interval: interval,
+		lines:    lines,
+		last:     time.Now(),
+		window:   newHDRHistogram(precision),
+	}
+}
+
+func (p *progress) add(res *result) {
+	p.n++
+	p.total++
+	if res.err != nil || res.failure != "" {
+		p.errors++
+		return
+	}
+	p.window.record(res.duration)
+}
+
+// print writes an update and starts a new window.
+func (p *progress) print(r *report) {
+	t := time.Now()
+	var rps float64
+	if d := t.Sub(p.last).Seconds(); d > 0 {
+		rps = float64(p.n) / d
+	}
+
+	var status bytes.Buffer
+	for c, n := range statusClasses(r.statusCodeDist) {
+		if n > 0 {
+			fmt.Fprintf(&status, ", %dxx: %d", c, n)
+		}
+	}
+
+	line := fmt.Sprintf("[%v] %d requests, %4.1f req/s, p50 %4.4f secs, p99 %4.4f secs, %d errors%s",
+		t.Sub(r.started).Round(time.Second), p.total, rps,
+		p.window.percentile(50).Seconds(), p.window.percentile(99).Seconds(), p.errors, status.String())
+	if p.lines {
+		fmt.Fprintln(p.w, line)
+	} else {
+		// Rewrite the line in place, clearing what is left of the last one.
+		fmt.Fprintf(p.w, "\r%s\033[K", line)
+	}
+
+	p.last = t
+	p.n = 0
+	p.window.reset()
+}
+
+// done clears the progress line, if it is written in place.
+func (p *progress) done() {
+	if !p.lines {
+		fmt.Fprint(p.w, "\r\033[K")
+	}
+}
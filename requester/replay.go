@@ -0,0 +1,264 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Replayed requests sent more than lateLag after they were due are
+// counted as late.
+const lateLag = 10 * time.Millisecond
+
+// The layout of the times of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// PacingReport compares when replayed requests were sent with when they
+// were due.
+type PacingReport struct {
+	// Speed is how many times faster than recorded the requests were
+	// scheduled.
+	Speed float64
+
+	// Scheduled is when the last request was due, and Actual when the
+	// last one was sent, since the start of the run.
+	Scheduled time.Duration
+	Actual    time.Duration
+
+	// AverageLag and MaxLag are how late the requests were sent, in
+	// seconds.
+	AverageLag float64
+	MaxLag     float64
+
+	// Late is the number of requests sent more than 10ms late.
+	Late int64
+}
+
+// pacing accumulates how late replayed requests were sent.
+type pacing struct {
+	speed     float64
+	scheduled time.Duration
+
+	n      int64
+	lag    time.Duration // sum of the lags
+	maxLag time.Duration
+	late   int64
+	last   time.Duration
+}
+
+func (p *pacing) add(res *result) {
+	p.n++
+	p.lag += res.lag
+	if res.lag > p.maxLag {
+		p.maxLag = res.lag
+	}
+	if res.lag > lateLag {
+		p.late++
+	}
+	if sent := res.offset + res.lag; sent > p.last {
+		p.last = sent
+	}
+}
+
+func (p *pacing) snapshot() *PacingReport {
+	r := &PacingReport{
+		Speed:     p.speed,
+		Scheduled: p.scheduled,
+		Actual:    p.last,
+		MaxLag:    p.maxLag.Seconds(),
+		Late:      p.late,
+	}
+	if p.n > 0 {
+		r.AverageLag = p.lag.Seconds() / float64(p.n)
+	}
+	return r
+}
+
+func (b *Work) replaySpeed() float64 {
+	if b.ReplaySpeed <= 0 {
+		return 1
+	}
+	return b.ReplaySpeed
+}
+
+// replayAt returns when the ith target is due, since the start of the run.
+func (b *Work) replayAt(i int) time.Duration {
+	if i < 0 {
+		return 0
+	}
+	return time.Duration(float64(b.Targets[i].Offset) / b.replaySpeed())
+}
+
+var (
+	// The start of a line in the Common or Combined Log Format, such as
+	// 127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /a.gif HTTP/1.0".
+	clfRegexp = regexp.MustCompile(`^\S+ \S+ .*?\[([^\]]+)\] "([^"]*)"`)
+
+	errNoRequest = errors.New("no request")
+)
+
+// LoadAccessLog reads the requests of a web server access log as targets
+// on base, such as "http://localhost:8080", with the Offset they were
+// received at since the first one, for Work.Replay. Each line is either
+// in the Common or Combined Log Format, whose times are to the second, or
+// a JSON object with the fields:
+//   - "method", "request_method" or "verb": the method. Defaults to GET.
+//   - "path", "uri", "request_uri" or "url": the path and query.
+//   - "request": the request line, such as "GET /a HTTP/1.1", instead.
+//   - "time", "timestamp", "@timestamp" or "time_local": an RFC 3339 or Common Log Format time, or a Unix time in seconds.
+//
+// Empty lines, and lines without a request line such as those of
+// malformed requests, are skipped.
+func LoadAccessLog(path, base string) ([]*Target, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("requester: base URL %q is not HTTP", base)
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type entry struct {
+		t  *Target
+		at time.Time
+	}
+	var entries []entry
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" {
+			continue
+		}
+		var method, uri string
+		var t time.Time
+		if strings.HasPrefix(text, "{") {
+			method, uri, t, err = parseJSONAccess(text)
+		} else {
+			method, uri, t, err = parseCLFAccess(text)
+		}
+		if err == errNoRequest {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if ru, err := url.Parse(uri); err == nil && ru.IsAbs() {
+			uri = ru.RequestURI()
+		}
+		if !strings.HasPrefix(uri, "/") {
+			uri = "/" + uri
+		}
+		target := &Target{Method: method, URL: base + uri}
+		if _, err := http.NewRequest(target.method(), target.URL, nil); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		entries = append(entries, entry{target, t})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no requests", path)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+	targets := make([]*Target, len(entries))
+	for i, e := range entries {
+		e.t.Offset = e.at.Sub(entries[0].at)
+		targets[i] = e.t
+	}
+	return targets, nil
+}
+
+func parseCLFAccess(text string) (method, uri string, t time.Time, err error) {
+	m := clfRegexp.FindStringSubmatch(text)
+	if m == nil {
+		return "", "", t, errors.New("not in the Common Log Format")
+	}
+	if t, err = time.Parse(clfTime, m[1]); err != nil {
+		return "", "", t, err
+	}
+	method, uri, err = parseRequestLine(m[2])
+	return method, uri, t, err
+}
+
+func parseJSONAccess(text string) (method, uri string, t time.Time, err error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &obj); err != nil {
+		return "", "", t, err
+	}
+	field := func(names ...string) interface{} {
+		for _, name := range names {
+			if v, ok := obj[name]; ok && v != nil {
+				return v
+			}
+		}
+		return nil
+	}
+
+	method, _ = field("method", "request_method", "verb").(string)
+	uri, _ = field("path", "uri", "request_uri", "url").(string)
+	if uri == "" {
+		line, _ := field("request").(string)
+		if method, uri, err = parseRequestLine(line); err != nil {
+			return "", "", t, err
+		}
+	}
+	switch v := field("time", "timestamp", "@timestamp", "time_local").(type) {
+	case string:
+		if t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			if t, err = time.Parse(clfTime, v); err != nil {
+				return "", "", t, fmt.Errorf("invalid time %q", v)
+			}
+		}
+	case float64:
+		sec, frac := math.Modf(v)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+	default:
+		return "", "", t, errors.New("missing time")
+	}
+	return method, uri, t, nil
+}
+
+// parseRequestLine returns the method and URI of a request line, such as
+// "GET /a HTTP/1.1".
+func parseRequestLine(line string) (method, uri string, err error) {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return "", "", errNoRequest
+	}
+	return f[0], f[1], nil
+}
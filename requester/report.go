@@ -15,10 +15,11 @@
 package requester
 
 import (
-	"bytes"
-	"fmt"
+	"bufio"
+	"encoding/json"
 	"io"
 	"log"
+	"math"
 	"sort"
 	"time"
 )
@@ -27,9 +28,15 @@ const (
 	barChar = "■"
 )
 
-// We report for max 1M results.
+// We keep raw samples for max 1M results.
 const maxRes = 1000000
 
+// How often the result log is flushed, so it can be followed during a run.
+var resultLogFlush = time.Second
+
+// Percentiles of the latency distribution.
+var pctls = []float64{10, 25, 50, 75, 90, 95, 99, 99.9, 99.99}
+
 type report struct {
 	avgTotal float64
 	fastest  float64
@@ -37,138 +44,368 @@ type report struct {
 	average  float64
 	rps      float64
 
-	avgConn     float64
-	avgDNS      float64
-	avgReq      float64
-	avgRes      float64
-	avgDelay    float64
+	targetRps float64
+	config    RunConfig
+
+	// resultLog, if set, gets every result as a line of JSON.
+	resultLog *bufio.Writer
+	started   time.Time
+
+	// progress, if set, writes interim statistics as results come in.
+	progress *progress
+
+	// windows, if set, splits the results into time windows.
+	windows *windows
+
+	// scenario, if set, gets the results of whole runs of the scenario.
+	scenario *group
+
+	// pacing, if set, compares when replayed requests were sent with
+	// their schedule.
+	pacing *pacing
+
+	// conns, if set, counts the connections of the run.
+	conns *connCounts
+
+	// warmUp, if set, gets the results of the warm-up, and steady is the
+	// offset of the first result after it.
+	warmUp       *group
+	steady       time.Duration
+	steadyResult bool
+	measured     time.Duration // the part of the run after the warm-up
+
+	stages      profile
+	stageGroups []*group
+	labelGroups map[string]*group
+	precision   int
+
+	avgConn  float64
+	avgDNS   float64
+	avgReq   float64
+	avgRes   float64
+	avgDelay float64
+
+	// Histograms of the total latency and of each phase of the requests.
+	latsHist  *hdrHistogram
+	connHist  *hdrHistogram
+	dnsHist   *hdrHistogram
+	reqHist   *hdrHistogram
+	resHist   *hdrHistogram
+	delayHist *hdrHistogram
+
+	// Raw samples, only kept if raw is set.
+	raw         bool
+	lats        []float64
 	connLats    []float64
 	dnsLats     []float64
 	reqLats     []float64
 	resLats     []float64
 	delayLats   []float64
 	offsets     []float64
+	labels      []string
 	statusCodes []int
 
 	results chan *result
 	done    chan bool
 	total   time.Duration
 
-	errorDist map[string]int
-	lats      []float64
-	sizeTotal int64
-	numRes    int64
-	output    string
+	errorDist      map[string]int
+	failureDist    map[string]int
+	statusCodeDist map[int]int
+	sizeTotal      int64
+	numRes         int64
+	cancelled      int64
+	failed5xx      int64 // failures with a 5xx status code
+	output         string
+
+	thresholds []ThresholdResult
+	passed     bool
 
 	w io.Writer
 }
 
-func newReport(w io.Writer, results chan *result, output string, n int) *report {
-	cap := min(n, maxRes)
-	return &report{
-		output:      output,
-		results:     results,
-		done:        make(chan bool, 1),
-		errorDist:   make(map[string]int),
-		w:           w,
-		connLats:    make([]float64, 0, cap),
-		dnsLats:     make([]float64, 0, cap),
-		reqLats:     make([]float64, 0, cap),
-		resLats:     make([]float64, 0, cap),
-		delayLats:   make([]float64, 0, cap),
-		lats:        make([]float64, 0, cap),
-		statusCodes: make([]int, 0, cap),
+// newReport returns a report that keeps precision significant digits of
+// the latencies and, if raw is set, the raw samples of the first n results.
+func newReport(w io.Writer, results chan *result, output string, n int, precision int, raw bool) *report {
+	r := &report{
+		output:         output,
+		results:        results,
+		done:           make(chan bool, 1),
+		errorDist:      make(map[string]int),
+		failureDist:    make(map[string]int),
+		statusCodeDist: make(map[int]int),
+		labelGroups:    make(map[string]*group),
+		precision:      precision,
+		w:              w,
+		latsHist:       newHDRHistogram(precision),
+		connHist:       newHDRHistogram(precision),
+		dnsHist:        newHDRHistogram(precision),
+		reqHist:        newHDRHistogram(precision),
+		resHist:        newHDRHistogram(precision),
+		delayHist:      newHDRHistogram(precision),
+		raw:            raw,
+	}
+	if raw {
+		cap := min(n, maxRes)
+		r.lats = make([]float64, 0, cap)
+		r.connLats = make([]float64, 0, cap)
+		r.dnsLats = make([]float64, 0, cap)
+		r.reqLats = make([]float64, 0, cap)
+		r.resLats = make([]float64, 0, cap)
+		r.delayLats = make([]float64, 0, cap)
+		r.statusCodes = make([]int, 0, cap)
 	}
+	return r
 }
 
 func runReporter(r *report) {
+	for i := range r.stages {
+		r.stageGroups = append(r.stageGroups, newGroup(r.stages.name(i), r.precision))
+	}
+	var enc *json.Encoder
+	var flush <-chan time.Time
+	if r.resultLog != nil {
+		enc = json.NewEncoder(r.resultLog)
+		t := time.NewTicker(resultLogFlush)
+		defer t.Stop()
+		flush = t.C
+	}
+	var tick <-chan time.Time
+	if r.progress != nil {
+		t := time.NewTicker(r.progress.interval)
+		defer t.Stop()
+		tick = t.C
+	}
 	// Loop will continue until channel is closed
-	for res := range r.results {
-		r.numRes++
-		if res.err != nil {
-			r.errorDist[res.err.Error()]++
-		} else {
-			r.avgTotal += res.duration.Seconds()
-			r.avgConn += res.connDuration.Seconds()
-			r.avgDelay += res.delayDuration.Seconds()
-			r.avgDNS += res.dnsDuration.Seconds()
-			r.avgReq += res.reqDuration.Seconds()
-			r.avgRes += res.resDuration.Seconds()
-			if len(r.resLats) < maxRes {
-				r.lats = append(r.lats, res.duration.Seconds())
-				r.connLats = append(r.connLats, res.connDuration.Seconds())
-				r.dnsLats = append(r.dnsLats, res.dnsDuration.Seconds())
-				r.reqLats = append(r.reqLats, res.reqDuration.Seconds())
-				r.delayLats = append(r.delayLats, res.delayDuration.Seconds())
-				r.resLats = append(r.resLats, res.resDuration.Seconds())
-				r.statusCodes = append(r.statusCodes, res.statusCode)
-				r.offsets = append(r.offsets, res.offset.Seconds())
+loop:
+	for {
+		select {
+		case res, ok := <-r.results:
+			if !ok {
+				break loop
+			}
+			if enc != nil {
+				if err := enc.Encode(newJSONResult(res, r.started)); err != nil {
+					log.Println("error:", err.Error())
+					enc = nil
+				}
 			}
-			if res.contentLength > 0 {
-				r.sizeTotal += res.contentLength
+			r.add(res)
+		case <-tick:
+			r.progress.print(r)
+		case <-flush:
+			if err := r.resultLog.Flush(); err != nil {
+				log.Println("error:", err.Error())
+				flush = nil
 			}
 		}
 	}
+	if r.progress != nil {
+		r.progress.done()
+	}
+	if r.resultLog != nil {
+		if err := r.resultLog.Flush(); err != nil {
+			log.Println("error:", err.Error())
+		}
+	}
 	// Signal reporter is done.
 	r.done <- true
 }
 
+// add records a result.
+func (r *report) add(res *result) {
+	if res.scenario {
+		if !res.cancelled && !res.warmUp {
+			r.scenario.add(res)
+		}
+		return
+	}
+	if res.cancelled {
+		r.cancelled++
+		return
+	}
+	if r.progress != nil {
+		r.progress.add(res)
+	}
+	if r.windows != nil {
+		r.windows.add(res, time.Since(r.started))
+	}
+	if r.pacing != nil {
+		r.pacing.add(res)
+	}
+	if res.warmUp {
+		r.warmUp.add(res)
+		return
+	}
+	if r.warmUp != nil && (!r.steadyResult || res.offset < r.steady) {
+		r.steady = res.offset
+		r.steadyResult = true
+	}
+	r.numRes++
+	if len(r.stageGroups) > 0 {
+		r.stageGroups[r.stageAt(res.offset)].add(res)
+	}
+	if res.label != "" {
+		g, ok := r.labelGroups[res.label]
+		if !ok {
+			g = newGroup(res.label, r.precision)
+			r.labelGroups[res.label] = g
+		}
+		g.add(res)
+	}
+	if res.err != nil {
+		r.errorDist[res.err.Error()]++
+	} else if res.failure != "" {
+		r.failureDist[res.failure]++
+		r.statusCodeDist[res.statusCode]++
+		if res.statusCode >= 500 {
+			r.failed5xx++
+		}
+	} else {
+		r.avgTotal += res.duration.Seconds()
+		r.latsHist.record(res.duration)
+		r.connHist.record(res.connDuration)
+		r.dnsHist.record(res.dnsDuration)
+		r.reqHist.record(res.reqDuration)
+		r.resHist.record(res.resDuration)
+		r.delayHist.record(res.delayDuration)
+		r.statusCodeDist[res.statusCode]++
+		if r.raw && len(r.resLats) < maxRes {
+			r.lats = append(r.lats, res.duration.Seconds())
+			r.connLats = append(r.connLats, res.connDuration.Seconds())
+			r.dnsLats = append(r.dnsLats, res.dnsDuration.Seconds())
+			r.reqLats = append(r.reqLats, res.reqDuration.Seconds())
+			r.delayLats = append(r.delayLats, res.delayDuration.Seconds())
+			r.resLats = append(r.resLats, res.resDuration.Seconds())
+			r.statusCodes = append(r.statusCodes, res.statusCode)
+			r.offsets = append(r.offsets, res.offset.Seconds())
+			r.labels = append(r.labels, res.label)
+		}
+		if res.contentLength > 0 {
+			r.sizeTotal += res.contentLength
+		}
+	}
+}
+
+// stageAt returns the index of the stage running at the given offset.
+func (r *report) stageAt(offset time.Duration) int {
+	var end time.Duration
+	for i, s := range r.stages {
+		end += s.Duration
+		if offset < end {
+			return i
+		}
+	}
+	return len(r.stages) - 1
+}
+
 func (r *report) finalize(total time.Duration) {
 	r.total = total
-	r.rps = float64(r.numRes) / r.total.Seconds()
-	r.average = r.avgTotal / float64(len(r.lats))
-	r.avgConn = r.avgConn / float64(len(r.lats))
-	r.avgDelay = r.avgDelay / float64(len(r.lats))
-	r.avgDNS = r.avgDNS / float64(len(r.lats))
-	r.avgReq = r.avgReq / float64(len(r.lats))
-	r.avgRes = r.avgRes / float64(len(r.lats))
-	r.print()
+	r.measured = total
+	if r.warmUp != nil {
+		r.measured = 0
+		if r.steadyResult {
+			r.measured = total - r.steady
+		}
+	}
+	if r.measured > 0 {
+		r.rps = float64(r.numRes) / r.measured.Seconds()
+	}
+	r.average = r.latsHist.mean().Seconds()
+	r.fastest = r.latsHist.min.Seconds()
+	r.slowest = r.latsHist.max.Seconds()
+	r.avgConn = r.connHist.mean().Seconds()
+	r.avgDelay = r.delayHist.mean().Seconds()
+	r.avgDNS = r.dnsHist.mean().Seconds()
+	r.avgReq = r.reqHist.mean().Seconds()
+	r.avgRes = r.resHist.mean().Seconds()
+	if r.windows != nil {
+		r.windows.finish(total)
+	}
 }
 
 func (r *report) print() {
-	buf := &bytes.Buffer{}
-	if err := newTemplate(r.output).Execute(buf, r.snapshot()); err != nil {
+	snapshot := r.snapshot()
+	if err := snapshot.Print(r.w, r.output); err != nil {
 		log.Println("error:", err.Error())
-		return
 	}
-	r.printf(buf.String())
-
-	r.printf("\n")
-}
-
-func (r *report) printf(s string, v ...interface{}) {
-	fmt.Fprintf(r.w, s, v...)
 }
 
 func (r *report) snapshot() Report {
 	snapshot := Report{
-		AvgTotal:    r.avgTotal,
-		Average:     r.average,
-		Rps:         r.rps,
-		SizeTotal:   r.sizeTotal,
-		AvgConn:     r.avgConn,
-		AvgDNS:      r.avgDNS,
-		AvgReq:      r.avgReq,
-		AvgRes:      r.avgRes,
-		AvgDelay:    r.avgDelay,
-		Total:       r.total,
-		ErrorDist:   r.errorDist,
-		NumRes:      r.numRes,
-		Lats:        make([]float64, len(r.lats)),
-		ConnLats:    make([]float64, len(r.lats)),
-		DnsLats:     make([]float64, len(r.lats)),
-		ReqLats:     make([]float64, len(r.lats)),
-		ResLats:     make([]float64, len(r.lats)),
-		DelayLats:   make([]float64, len(r.lats)),
-		Offsets:     make([]float64, len(r.lats)),
-		StatusCodes: make([]int, len(r.lats)),
-	}
-
-	if len(r.lats) == 0 {
-		return snapshot
+		AvgTotal:       r.avgTotal,
+		Average:        r.average,
+		Fastest:        r.fastest,
+		Slowest:        r.slowest,
+		Rps:            r.rps,
+		TargetRps:      r.targetRps,
+		Config:         r.config,
+		SizeTotal:      r.sizeTotal,
+		AvgConn:        r.avgConn,
+		AvgDNS:         r.avgDNS,
+		AvgReq:         r.avgReq,
+		AvgRes:         r.avgRes,
+		AvgDelay:       r.avgDelay,
+		Total:          r.measured,
+		ErrorDist:      r.errorDist,
+		FailureDist:    r.failureDist,
+		StatusCodeDist: r.statusCodeDist,
+		NumRes:         r.numRes,
+		Cancelled:      r.cancelled,
+		failed5xx:      r.failed5xx,
+		Thresholds:     r.thresholds,
+		Lats:           make([]float64, len(r.lats)),
+		ConnLats:       make([]float64, len(r.lats)),
+		DnsLats:        make([]float64, len(r.lats)),
+		ReqLats:        make([]float64, len(r.lats)),
+		ResLats:        make([]float64, len(r.lats)),
+		DelayLats:      make([]float64, len(r.lats)),
+		Offsets:        make([]float64, len(r.lats)),
+		ResultLabels:   make([]string, len(r.lats)),
+		StatusCodes:    make([]int, len(r.lats)),
 	}
 
-	snapshot.SizeReq = r.sizeTotal / int64(len(r.lats))
+	var start time.Duration
+	for i, g := range r.stageGroups {
+		end := start + r.stages[i].Duration
+		if end > r.total {
+			end = r.total
+		}
+		var d time.Duration
+		if end > start {
+			d = end - start
+		}
+		snapshot.Stages = append(snapshot.Stages, g.snapshot(d))
+		start += r.stages[i].Duration
+	}
+	for _, g := range r.labelGroups {
+		snapshot.Labels = append(snapshot.Labels, g.snapshot(r.measured))
+	}
+	sort.Slice(snapshot.Labels, func(i, j int) bool {
+		return snapshot.Labels[i].Name < snapshot.Labels[j].Name
+	})
+	if r.windows != nil {
+		snapshot.Windows = r.windows.closed
+		snapshot.WindowsLate = r.windows.late
+	}
+	if r.pacing != nil {
+		snapshot.Pacing = r.pacing.snapshot()
+	}
+	if r.conns != nil {
+		snapshot.Connections = r.conns.snapshot()
+	}
+	if r.scenario != nil {
+		scenario := r.scenario.snapshot(r.measured)
+		snapshot.Scenario = &scenario
+	}
+	if r.warmUp != nil {
+		d := r.total
+		if r.steadyResult {
+			d = r.steady
+		}
+		warmUp := r.warmUp.snapshot(d)
+		snapshot.WarmUp = &warmUp
+	}
 
 	copy(snapshot.Lats, r.lats)
 	copy(snapshot.ConnLats, r.connLats)
@@ -178,102 +415,51 @@ func (r *report) snapshot() Report {
 	copy(snapshot.DelayLats, r.delayLats)
 	copy(snapshot.StatusCodes, r.statusCodes)
 	copy(snapshot.Offsets, r.offsets)
+	copy(snapshot.ResultLabels, r.labels)
 
-	sort.Float64s(r.lats)
-	r.fastest = r.lats[0]
-	r.slowest = r.lats[len(r.lats)-1]
-
-	sort.Float64s(r.connLats)
-	sort.Float64s(r.dnsLats)
-	sort.Float64s(r.reqLats)
-	sort.Float64s(r.resLats)
-	sort.Float64s(r.delayLats)
-
-	snapshot.Histogram = r.histogram()
-	snapshot.LatencyDistribution = r.latencies()
-
-	snapshot.Fastest = r.fastest
-	snapshot.Slowest = r.slowest
-	snapshot.ConnMax = r.connLats[0]
-	snapshot.ConnMin = r.connLats[len(r.connLats)-1]
-	snapshot.DnsMax = r.dnsLats[0]
-	snapshot.DnsMin = r.dnsLats[len(r.dnsLats)-1]
-	snapshot.ReqMax = r.reqLats[0]
-	snapshot.ReqMin = r.reqLats[len(r.reqLats)-1]
-	snapshot.DelayMax = r.delayLats[0]
-	snapshot.DelayMin = r.delayLats[len(r.delayLats)-1]
-	snapshot.ResMax = r.resLats[0]
-	snapshot.ResMin = r.resLats[len(r.resLats)-1]
-
-	statusCodeDist := make(map[int]int, len(snapshot.StatusCodes))
-	for _, statusCode := range snapshot.StatusCodes {
-		statusCodeDist[statusCode]++
-	}
-	snapshot.StatusCodeDist = statusCodeDist
+	if r.latsHist.total == 0 {
+		return snapshot
+	}
 
-	return snapshot
-}
+	snapshot.SizeReq = r.sizeTotal / r.latsHist.total
 
-func (r *report) latencies() []LatencyDistribution {
-	pctls := []int{10, 25, 50, 75, 90, 95, 99}
-	data := make([]float64, len(pctls))
-	j := 0
-	for i := 0; i < len(r.lats) && j < len(pctls); i++ {
-		current := i * 100 / len(r.lats)
-		if current >= pctls[j] {
-			data[j] = r.lats[i]
-			j++
-		}
-	}
-	res := make([]LatencyDistribution, len(pctls))
-	for i := 0; i < len(pctls); i++ {
-		if data[i] > 0 {
-			res[i] = LatencyDistribution{Percentage: pctls[i], Latency: data[i]}
-		}
-	}
-	return res
-}
+	snapshot.Histogram = r.latsHist.buckets()
+	snapshot.LatencyDistribution = r.latsHist.latencies()
 
-func (r *report) histogram() []Bucket {
-	bc := 10
-	buckets := make([]float64, bc+1)
-	counts := make([]int, bc+1)
-	bs := (r.slowest - r.fastest) / float64(bc)
-	for i := 0; i < bc; i++ {
-		buckets[i] = r.fastest + bs*float64(i)
-	}
-	buckets[bc] = r.slowest
-	var bi int
-	var max int
-	for i := 0; i < len(r.lats); {
-		if r.lats[i] <= buckets[bi] {
-			i++
-			counts[bi]++
-			if max < counts[bi] {
-				max = counts[bi]
-			}
-		} else if bi < len(buckets)-1 {
-			bi++
-		}
-	}
-	res := make([]Bucket, len(buckets))
-	for i := 0; i < len(buckets); i++ {
-		res[i] = Bucket{
-			Mark:      buckets[i],
-			Count:     counts[i],
-			Frequency: float64(counts[i]) / float64(len(r.lats)),
-		}
-	}
-	return res
+	snapshot.ConnMax = r.connHist.min.Seconds()
+	snapshot.ConnMin = r.connHist.max.Seconds()
+	snapshot.DnsMax = r.dnsHist.min.Seconds()
+	snapshot.DnsMin = r.dnsHist.max.Seconds()
+	snapshot.ReqMax = r.reqHist.min.Seconds()
+	snapshot.ReqMin = r.reqHist.max.Seconds()
+	snapshot.DelayMax = r.delayHist.min.Seconds()
+	snapshot.DelayMin = r.delayHist.max.Seconds()
+	snapshot.ResMax = r.resHist.min.Seconds()
+	snapshot.ResMin = r.resHist.max.Seconds()
+
+	snapshot.ConnDistribution = r.connHist.latencies()
+	snapshot.DNSDistribution = r.dnsHist.latencies()
+	snapshot.ReqDistribution = r.reqHist.latencies()
+	snapshot.DelayDistribution = r.delayHist.latencies()
+	snapshot.ResDistribution = r.resHist.latencies()
+
+	return snapshot
 }
 
 type Report struct {
+	// Config is the configuration of the run.
+	Config RunConfig
+
 	AvgTotal float64
 	Fastest  float64
 	Slowest  float64
 	Average  float64
 	Rps      float64
 
+	// TargetRps is the total request rate the run was configured for,
+	// or zero if it was not rate limited.
+	TargetRps float64
+
 	AvgConn  float64
 	AvgDNS   float64
 	AvgReq   float64
@@ -290,6 +476,8 @@ type Report struct {
 	DelayMax float64
 	DelayMin float64
 
+	// The raw samples of the first results, up to one million, if the
+	// run kept them. Latencies are in seconds.
 	Lats        []float64
 	ConnLats    []float64
 	DnsLats     []float64
@@ -299,20 +487,165 @@ type Report struct {
 	Offsets     []float64
 	StatusCodes []int
 
+	// ResultLabels holds the label of each raw sample, if any.
+	ResultLabels []string
+
+	// Total is the length of the run, after the warm-up if it had one.
 	Total time.Duration
 
-	ErrorDist      map[string]int
+	ErrorDist map[string]int
+	// FailureDist counts the responses that did not match Work.Expect
+	// by the reason they did not. They are included in StatusCodeDist,
+	// but not in the other statistics, which only cover successful
+	// requests.
+	FailureDist    map[string]int
 	StatusCodeDist map[int]int
 	SizeTotal      int64
 	SizeReq        int64
 	NumRes         int64
 
+	// Cancelled is the number of requests that were in flight when the
+	// run was stopped. They are not included in the other statistics.
+	Cancelled int64
+
+	failed5xx int64 // failures counted in StatusCodeDist as 5xx too
+
+	// Scenario summarizes the whole runs of the scenario, if the run had
+	// one. Their latencies leave out the think times, and a run stopped by
+	// a failed step is reported under the error or failure of the step.
+	Scenario *GroupReport
+
+	// Pacing compares when the requests were sent with their schedule,
+	// if they were replayed.
+	Pacing *PacingReport
+
+	// Connections counts the connections the requests were sent on.
+	Connections ConnectionReport
+
 	LatencyDistribution []LatencyDistribution
 	Histogram           []Bucket
+
+	// Latency distributions of the phases of the requests: connection
+	// setup, DNS lookup, request write, response wait and response read.
+	ConnDistribution  []LatencyDistribution
+	DNSDistribution   []LatencyDistribution
+	ReqDistribution   []LatencyDistribution
+	DelayDistribution []LatencyDistribution
+	ResDistribution   []LatencyDistribution
+
+	// Stages holds the results of each stage of the load profile,
+	// if the run had one.
+	Stages []GroupReport
+
+	// Labels holds the results of each label, sorted by label.
+	// Requests without a label are only counted in the totals.
+	Labels []GroupReport
+
+	// Thresholds holds the outcome of each of Work.Thresholds.
+	Thresholds []ThresholdResult
+
+	// WarmUp holds the results of the warm-up, if the run had one. Its
+	// Total is the time until the first request after it was sent.
+	WarmUp *GroupReport
+
+	// Windows holds the results of each time window of Work.Window, in
+	// order.
+	Windows []WindowReport
+
+	// WindowsLate is the number of results left out of Windows because
+	// their window was already closed, such as requests in flight for
+	// longer than two windows when there is no timeout.
+	WindowsLate int64
+}
+
+// Passed reports whether the run met all of its thresholds.
+func (r *Report) Passed() bool {
+	for _, t := range r.Thresholds {
+		if !t.Pass {
+			return false
+		}
+	}
+	return true
 }
 
+// errorRate returns the fraction of requests that failed with an error,
+// did not match Work.Expect or had a 5xx status code, or NaN if there
+// were no requests.
+func (r *Report) errorRate() float64 {
+	if r.NumRes == 0 {
+		return math.NaN()
+	}
+	var n int
+	for _, c := range r.ErrorDist {
+		n += c
+	}
+	for _, c := range r.FailureDist {
+		n += c
+	}
+	for code, c := range r.StatusCodeDist {
+		if code >= 500 {
+			n += c
+		}
+	}
+	// Failures with a 5xx status code are in both distributions.
+	n -= int(r.failed5xx)
+	return float64(n) / float64(r.NumRes)
+}
+
+// RunConfig describes the configuration of a run.
+type RunConfig struct {
+	Method             string
+	URL                string
+	Targets            int
+	N                  int
+	C                  int
+	QPS                float64
+	GlobalQPS          bool
+	Rate               float64
+	Stages             []Stage
+	WarmUp             time.Duration
+	WarmUpRequests     int
+	ReplaySpeed        float64
+	Timeout            int
+	H2                 bool
+	DisableCompression bool
+	DisableKeepAlives  bool
+	DisableRedirects   bool
+	CookieJars         bool
+	WorkerConnections  bool
+	Connections        int
+	MaxConnsPerHost    int
+	Proxy              string
+}
+
+// GroupReport summarizes the results of a subset of the requests.
+// Latencies are in seconds.
+type GroupReport struct {
+	Name    string
+	Total   time.Duration
+	NumRes  int64
+	Rps     float64
+	Average float64
+	Fastest float64
+	Slowest float64
+
+	ErrorDist      map[string]int
+	FailureDist    map[string]int
+	StatusCodeDist map[int]int
+	SizeTotal      int64
+
+	LatencyDistribution []LatencyDistribution
+	Histogram           []Bucket
+}
+
+// LatencyDistribution is the latency under which a percentile of the
+// requests completed.
 type LatencyDistribution struct {
+	// Percentage is Percentile rounded down to an integer, so 99.9 and
+	// 99.99 read as 99. Use Percentile to tell them apart.
 	Percentage int
+
+	Percentile float64
 	Latency    float64
 }
 
@@ -321,3 +654,70 @@ type Bucket struct {
 	Count     int
 	Frequency float64
 }
+
+// group collects the results of a subset of the requests, such as the
+// ones sent during one stage of a load profile or the ones with the same
+// label.
+type group struct {
+	name      string
+	numRes    int64
+	lats      *hdrHistogram
+	sizeTotal int64
+
+	statusCodeDist map[int]int
+	errorDist      map[string]int
+	failureDist    map[string]int
+}
+
+func newGroup(name string, precision int) *group {
+	return &group{
+		name:           name,
+		lats:           newHDRHistogram(precision),
+		statusCodeDist: make(map[int]int),
+		errorDist:      make(map[string]int),
+		failureDist:    make(map[string]int),
+	}
+}
+
+func (g *group) add(res *result) {
+	g.numRes++
+	if res.err != nil {
+		g.errorDist[res.err.Error()]++
+		return
+	}
+	g.statusCodeDist[res.statusCode]++
+	if res.failure != "" {
+		g.failureDist[res.failure]++
+		return
+	}
+	g.lats.record(res.duration)
+	if res.contentLength > 0 {
+		g.sizeTotal += res.contentLength
+	}
+}
+
+// snapshot summarizes the group. total is the time the requests of the
+// group were sent over.
+func (g *group) snapshot(total time.Duration) GroupReport {
+	gr := GroupReport{
+		Name:           g.name,
+		Total:          total,
+		NumRes:         g.numRes,
+		ErrorDist:      g.errorDist,
+		FailureDist:    g.failureDist,
+		StatusCodeDist: g.statusCodeDist,
+		SizeTotal:      g.sizeTotal,
+	}
+	if total > 0 {
+		gr.Rps = float64(g.numRes) / total.Seconds()
+	}
+	if g.lats.total == 0 {
+		return gr
+	}
+	gr.Average = g.lats.mean().Seconds()
+	gr.Fastest = g.lats.min.Seconds()
+	gr.Slowest = g.lats.max.Seconds()
+	gr.LatencyDistribution = g.lats.latencies()
+	gr.Histogram = g.lats.buckets()
+	return gr
+}
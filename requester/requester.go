@@ -16,15 +16,25 @@
 package requester
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptrace"
 	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -36,6 +46,7 @@ const maxIdleConn = 500
 
 type result struct {
 	err           error
+	failure       string // why the response did not match Work.Expect
 	statusCode    int
 	offset        time.Duration
 	duration      time.Duration
@@ -45,6 +56,12 @@ type result struct {
 	resDuration   time.Duration // response "read" duration
 	delayDuration time.Duration // delay between response and request
 	contentLength int64
+	label         string        // name of the target, if any
+	url           string        // only set if results are logged
+	cancelled     bool          // the run was stopped while the request was in flight
+	warmUp        bool          // sent during the warm-up
+	lag           time.Duration // how late the request was sent, in open-loop mode
+	scenario      bool          // a whole run of the scenario rather than a request
 }
 
 type Work struct {
@@ -54,9 +71,73 @@ type Work struct {
 	RequestBody []byte
 
 	// RequestFunc is a function to generate requests. If it is nil, then
-	// Request and RequestData are cloned for each request.
+	// Request and RequestData are cloned for each request. Requests
+	// labeled with WithLabel are also reported per label. The values of
+	// the context of the requests are kept, but they are sent with the
+	// context of the run, so they are cancelled when it stops. If it
+	// returns nil, such as when a Feeder it reads is exhausted, no more
+	// requests are sent.
 	RequestFunc func() *http.Request
 
+	// Scenario, if set, is run by every worker, as a virtual user, instead
+	// of sending Request or Targets. N and WarmUpRequests then count runs
+	// of the scenario, and {{seq}} is the number of the run. The steps
+	// are also reported under their names, and whole runs in
+	// Report.Scenario. A Feeder gives a row to each run.
+	Scenario *Scenario
+
+	// Targets is a list of requests to pick from instead of Request. The
+	// results are also reported per target label. Ignored if RequestFunc
+	// is set.
+	Targets []*Target
+
+	// TargetOrder is how a target is picked for each request: "random"
+	// picks any of them at random, "weighted" picks them at random in
+	// proportion to their weights, "session" makes each worker go through
+	// them in order, over and over, like a recorded session, and anything
+	// else cycles through them in order.
+	TargetOrder string
+
+	// KeepTiming makes each worker in the "session" order send every
+	// target no sooner than its Offset after the worker sent the first
+	// target of its pass, as they were recorded. The wait is not counted
+	// in the latencies. Ignored with Rate or Stages.
+	KeepTiming bool
+
+	// Replay sends each of Targets once, in order, at its Offset since
+	// the start of the run divided by ReplaySpeed, whatever the responses,
+	// such as to replay recorded traffic. The requests are sent by the
+	// first of the C workers free, and their latencies are measured from
+	// the scheduled times. Report.Pacing compares when they were sent with
+	// the schedule. N, QPS, Rate, Stages and TargetOrder are ignored, and
+	// the results are not reported per target.
+	Replay bool
+
+	// ReplaySpeed scales the schedule of Replay: 2 sends the requests
+	// twice as fast as they were recorded. Defaults to 1.
+	ReplaySpeed float64
+
+	// Templated makes the path and query of the URL, the header values
+	// and the body of Request and of each of Targets templates, whose
+	// placeholders are replaced for every request:
+	//   - {{seq}}: the number of the request in the run, from 1.
+	//   - {{worker}}: the number of the worker sending it, from 0.
+	//   - {{uuid}}: a random UUID.
+	//   - {{randInt min max}}: a random integer from min to max.
+	//   - {{randString n}}: a random string of n letters and digits.
+	//   - {{timestamp}} and {{timestampMs}}: the Unix time in seconds and milliseconds.
+	//   - {{data.name}}: the field name of the row of Feeder the request was given.
+	// Templates are parsed once, when the run starts; if one does not
+	// parse, RunContext returns the error and Run logs it, and no
+	// requests are made.
+	Templated bool
+
+	// Feeder, if set, gives each request a row of data, which its
+	// templates can refer to. Setting it implies Templated. If it is
+	// unique, no more requests are sent once it is exhausted. It is not
+	// used for requests from RequestFunc, which can call Feeder.Next.
+	Feeder *Feeder
+
 	// N is the total number of requests to make.
 	N int
 
@@ -72,6 +153,23 @@ type Work struct {
 	// Qps is the rate limit in queries per second.
 	QPS float64
 
+	// GlobalQPS applies QPS to the total throughput of all workers
+	// rather than to each worker separately.
+	GlobalQPS bool
+
+	// Rate is the arrival rate in requests per second across all workers.
+	// If set, requests are sent on a fixed schedule that does not depend on
+	// how long earlier requests took, and each latency is measured from the
+	// time the request was scheduled to be sent. QPS is ignored.
+	Rate float64
+
+	// Stages is an optional load profile. If set, the run lasts for the
+	// total duration of the stages and N is ignored. For a concurrency
+	// profile the number of workers follows the stage targets and C is
+	// ignored; for a rate profile C is the number of workers sending the
+	// scheduled requests. The results are also reported for each stage.
+	Stages []Stage
+
 	// DisableCompression is an option to disable compression in response
 	DisableCompression bool
 
@@ -81,10 +179,38 @@ type Work struct {
 	// DisableRedirects is an option to prevent the following of HTTP redirects
 	DisableRedirects bool
 
+	// CookieJars gives each worker a cookie jar of its own, which keeps
+	// the cookies set by the responses, including redirects, and sends
+	// them with the later requests of the worker, as a browser session
+	// would. Without it, cookies are not kept.
+	CookieJars bool
+
+	// WorkerConnections gives each worker connections of its own, rather
+	// than a pool shared by all of them.
+	WorkerConnections bool
+
+	// Connections, if set, makes the workers share that many connections
+	// to each host, each worker always sending on the same one, such as
+	// to spread HTTP/2 requests over several connections rather than
+	// multiplexing them all over one. Ignored with WorkerConnections.
+	Connections int
+
+	// MaxConnsPerHost, if set, caps the connections of each pool to a
+	// host; requests wait for one of them to be free.
+	MaxConnsPerHost int
+
 	// Output represents the output type. If "csv" is provided, the
-	// output will be dumped as a csv stream.
+	// output will be dumped as a csv stream. If "json" is provided, the
+	// summary will be written in the JSON format of JSONReport.
 	Output string
 
+	// TLSConfig, if set, is the TLS configuration of the connections,
+	// such as to verify the certificates of the servers or to present one;
+	// see TLSOptions. Its ServerName defaults to the Host of Request. If
+	// nil, certificates are not verified. Errors of the TLS handshake are
+	// reported under "TLS handshake", without the URL of the request.
+	TLSConfig *tls.Config
+
 	// ProxyAddr is the address of HTTP proxy server in the format on "host:port".
 	// Optional.
 	ProxyAddr *url.URL
@@ -92,10 +218,78 @@ type Work struct {
 	// Writer is where results will be written. If nil, results are written to stdout.
 	Writer io.Writer
 
+	// HistogramPrecision is the number of significant decimal digits,
+	// from 1 to 5, latencies are recorded with, to the microsecond.
+	// Defaults to 3. Latencies are recorded in histograms, so the memory
+	// a run takes does not grow with its length; each takes about 140KB
+	// at 3 and 10MB at 5 for latencies of a minute.
+	HistogramPrecision int
+
+	// RawSamples keeps the latencies of the first million results as
+	// well, in Report.Lats and the other raw sample fields. They are
+	// always kept for CSV and custom template output.
+	RawSamples bool
+
+	// Expect, if set, describes the responses expected. Responses that
+	// do not match are reported as failures, separately from successful
+	// requests and from errors.
+	Expect *Expect
+
+	// WarmUp and WarmUpRequests make the requests started during the
+	// first WarmUp of the run, and the first WarmUpRequests requests, a
+	// warm-up: they are sent as usual, but their results are reported in
+	// Report.WarmUp rather than in the other statistics, and the run is
+	// measured from the end of the warm-up. N and the length of the run
+	// include the warm-up.
+	WarmUp         time.Duration
+	WarmUpRequests int
+
+	// Window, if set, splits the results into time windows of this length
+	// by the time the requests were started, for Report.Windows. Unlike
+	// the other statistics, the windows include the warm-up. A window is
+	// closed once its requests time out, or two windows after it ends if
+	// Timeout is 0; later results are counted in Report.WindowsLate.
+	Window time.Duration
+
+	// Thresholds are conditions the results must meet. They are checked
+	// when the run finishes, and the outcome is included in the summary.
+	Thresholds []Threshold
+
+	// Progress, if set, is where interim statistics are written every
+	// ProgressInterval while the run goes: the time elapsed, the requests
+	// done, the throughput and latency percentiles of the last interval,
+	// the errors and the status code classes. They are written on a single
+	// line rewritten in place, as for a terminal, unless ProgressLines is
+	// set.
+	Progress io.Writer
+
+	// ProgressInterval is the time between progress updates. Defaults to
+	// one second.
+	ProgressInterval time.Duration
+
+	// ProgressLines writes each progress update on a line of its own,
+	// such as for CI logs.
+	ProgressLines bool
+
+	// ResultLog, if set, is where every result, including failed requests,
+	// is written as it completes, one JSONResult object per line. It is
+	// flushed every second.
+	ResultLog io.Writer
+
 	initOnce sync.Once
 	results  chan *result
-	stopCh   chan struct{}
+	sent     int64 // number of requests sent, updated atomically
+	stopOnce sync.Once
+	stopCh   chan struct{} // closed to stop the run
+	ctx      context.Context
 	start    time.Duration
+	limiter  *limiter
+	picker   *targetPicker
+	steps    []preparedStep   // of Scenario
+	tmpl     *requestTemplate // of Request, if Templated
+	rands    []*rand.Rand     // of each worker, if Templated
+	conns    connCounts
+	initErr  error
 
 	report *report
 }
@@ -111,50 +305,265 @@ func (b *Work) writer() io.Writer {
 func (b *Work) Init() {
 	b.initOnce.Do(func() {
 		b.results = make(chan *result, min(b.C*1000, maxResult))
-		b.stopCh = make(chan struct{}, b.C)
+		b.stopCh = make(chan struct{})
+		if b.Scenario != nil {
+			b.steps, b.initErr = prepareScenario(b.Scenario, b.Feeder)
+		} else if len(b.Targets) > 0 {
+			b.picker = newTargetPicker(b.Targets, b.TargetOrder, b.workers(), b.templated(), b.Feeder)
+			for _, t := range b.picker.targets {
+				if t.err != nil && b.initErr == nil {
+					b.initErr = t.err
+				}
+			}
+		}
+		if b.templated() {
+			if b.Request != nil && b.picker == nil && b.RequestFunc == nil && b.Scenario == nil {
+				if b.tmpl, b.initErr = newRequestTemplate(b.Request, b.RequestBody, tmplScope{feeder: b.Feeder}); b.initErr != nil {
+					b.initErr = fmt.Errorf("requester: %v", b.initErr)
+				}
+			}
+			seed := time.Now().UnixNano()
+			for i := 0; i < b.workers(); i++ {
+				b.rands = append(b.rands, rand.New(rand.NewSource(seed+int64(i))))
+			}
+		}
 	})
 }
 
 // Run makes all the requests, prints the summary. It blocks until
-// all work is done.
+// all work is done. If the work is invalid, such as a template that does
+// not parse, it logs why and makes no requests.
 func (b *Work) Run() {
+	if err := b.prepare(); err != nil {
+		log.Println("error:", err.Error())
+		return
+	}
+	b.run(context.Background())
+	b.Finish()
+}
+
+// RunContext makes all the requests, or as many as it can before ctx is
+// done, and returns the report without printing it; Report.Print formats
+// it. If ctx is done before all the
+// requests are made, it returns the report of the requests made so far
+// along with ctx.Err().
+func (b *Work) RunContext(ctx context.Context) (*Report, error) {
+	if err := b.prepare(); err != nil {
+		return nil, err
+	}
+	b.run(ctx)
+	b.finish()
+	r := b.report.snapshot()
+	return &r, ctx.Err()
+}
+
+// prepare checks the work and initializes it, before it is run.
+func (b *Work) prepare() error {
+	if b.Request == nil && b.RequestFunc == nil && len(b.Targets) == 0 && b.Scenario == nil {
+		return errors.New("requester: no request to make")
+	}
+	if b.workers() <= 0 {
+		return errors.New("requester: no workers to run")
+	}
+	if b.Replay && len(b.Targets) == 0 {
+		return errors.New("requester: no targets to replay")
+	}
+	b.Init()
+	return b.initErr
+}
+
+// run starts the reporter and makes all the requests, until they are
+// all made or the run is stopped, either by Stop or by ctx.
+func (b *Work) run(ctx context.Context) {
 	b.Init()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Workers stop when ctx is done, which also cancels the requests in
+	// flight.
+	b.ctx = ctx
+	go func() {
+		select {
+		case <-b.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 	b.start = now()
-	b.report = newReport(b.writer(), b.results, b.Output, b.N)
+	raw := b.RawSamples || (b.Output != "" && b.Output != "json")
+	b.report = newReport(b.writer(), b.results, b.Output, b.N, b.HistogramPrecision, raw)
+	b.report.targetRps = b.targetRate()
+	b.report.stages = profile(b.Stages)
+	b.report.config = b.config()
+	b.report.conns = &b.conns
+	b.report.started = time.Now()
+	if b.ResultLog != nil {
+		b.report.resultLog = bufio.NewWriter(b.ResultLog)
+	}
+	if b.WarmUp > 0 || b.WarmUpRequests > 0 {
+		b.report.warmUp = newGroup("Warm-up", b.HistogramPrecision)
+	}
+	if b.Window > 0 {
+		b.report.windows = newWindows(b.Window, time.Duration(b.Timeout)*time.Second, b.HistogramPrecision)
+	}
+	if b.Scenario != nil {
+		b.report.scenario = newGroup(b.scenarioName(), b.HistogramPrecision)
+	}
+	if b.Replay {
+		b.report.pacing = &pacing{speed: b.replaySpeed(), scheduled: b.replayAt(len(b.Targets) - 1)}
+	}
+	if b.Progress != nil {
+		b.report.progress = newProgress(b.Progress, b.ProgressInterval, b.ProgressLines, b.HistogramPrecision)
+	}
 	// Run the reporter first, it polls the result channel until it is closed.
 	go func() {
 		runReporter(b.report)
 	}()
 	b.runWorkers()
-	b.Finish()
 }
 
-func (b *Work) Stop() {
-	// Send stop signal so that workers can stop gracefully.
-	for i := 0; i < b.C; i++ {
-		b.stopCh <- struct{}{}
+func (b *Work) config() RunConfig {
+	c := RunConfig{
+		Targets:            len(b.Targets),
+		N:                  b.N,
+		C:                  b.C,
+		QPS:                b.QPS,
+		GlobalQPS:          b.GlobalQPS,
+		Rate:               b.Rate,
+		Stages:             b.Stages,
+		WarmUp:             b.WarmUp,
+		WarmUpRequests:     b.WarmUpRequests,
+		Timeout:            b.Timeout,
+		H2:                 b.H2,
+		DisableCompression: b.DisableCompression,
+		DisableKeepAlives:  b.DisableKeepAlives,
+		DisableRedirects:   b.DisableRedirects,
+		CookieJars:         b.CookieJars,
+		WorkerConnections:  b.WorkerConnections,
+		Connections:        b.Connections,
+		MaxConnsPerHost:    b.MaxConnsPerHost,
+	}
+	if b.Request != nil {
+		c.Method = b.Request.Method
+		c.URL = b.Request.URL.String()
 	}
+	if b.ProxyAddr != nil {
+		c.Proxy = b.ProxyAddr.String()
+	}
+	if b.Replay {
+		c.ReplaySpeed = b.replaySpeed()
+	}
+	return c
+}
+
+// workers returns the number of workers the run uses.
+func (b *Work) workers() int {
+	if p := profile(b.Stages); len(p) > 0 && !p.isRate() {
+		return p.maxC()
+	}
+	return b.C
+}
+
+// targetRate returns the total number of requests per second the
+// configuration asks for, or zero if it is not rate limited.
+func (b *Work) targetRate() float64 {
+	switch {
+	case len(b.Stages) > 0 || b.Replay:
+		return 0
+	case b.Rate > 0:
+		return b.Rate
+	case b.QPS > 0 && b.GlobalQPS:
+		return b.QPS
+	case b.QPS > 0:
+		return b.QPS * float64(b.C)
+	}
+	return 0
+}
+
+// Stop stops the run: no more requests are sent, and the requests in
+// flight are cancelled and reported as such rather than as errors. It
+// does not block, and can be called any number of times, from any
+// goroutine.
+func (b *Work) Stop() {
+	b.Init()
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+	})
 }
 
 func (b *Work) Finish() {
+	b.finish()
+	b.report.print()
+}
+
+// finish waits for the reporter and computes the final statistics.
+func (b *Work) finish() {
 	close(b.results)
 	total := now() - b.start
 	// Wait until the reporter is done.
 	<-b.report.done
 	b.report.finalize(total)
+	if len(b.Thresholds) > 0 {
+		snapshot := b.report.snapshot()
+		b.report.thresholds, b.report.passed = CheckThresholds(&snapshot, b.Thresholds)
+	}
 }
 
-func (b *Work) makeRequest(c *http.Client) {
-	s := now()
+// Passed reports whether the results of the run met all of its
+// thresholds. It is only meaningful once the run has finished, and is
+// false if the work could not be run.
+func (b *Work) Passed() bool {
+	return b.report != nil && (len(b.Thresholds) == 0 || b.report.passed)
+}
+
+// do runs the scenario once, if the run has one, or else sends a single
+// request. See makeRequest.
+func (b *Work) do(c *http.Client, s time.Duration, worker, i int) bool {
+	if b.steps != nil {
+		return b.runScenario(c, s, worker)
+	}
+	return b.makeRequest(c, s, worker, i)
+}
+
+// makeRequest sends a single request and reports its result. s is the
+// time the request is considered to have started; in open-loop mode it is
+// the scheduled send time, so any time spent waiting for a free worker is
+// counted in the latency, and i is the number of the scheduled request,
+// or -1 otherwise. It returns false if there are no more requests to
+// send.
+func (b *Work) makeRequest(c *http.Client, s time.Duration, worker, i int) bool {
+	lag := now() - s
+	n := atomic.AddInt64(&b.sent, 1)
+	warmUp := s-b.start < b.WarmUp || n <= int64(b.WarmUpRequests)
+	req, label, err := b.newRequest(n, worker, i)
+	if err == errNoMoreRequests {
+		return false
+	}
+	var res *result
+	if err != nil {
+		res = &result{offset: s - b.start, err: err}
+	} else {
+		res = b.send(c, req, s, nil)
+	}
+	res.label = label
+	res.warmUp = warmUp
+	res.lag = lag
+	b.results <- res
+	return true
+}
+
+// send sends req and returns its result, s being the time it is
+// considered to have started. read, if not nil, reads the response and
+// returns why it is a failure, if it is, and the size of its body,
+// instead of checking it against Expect. The size of a result is the
+// number of bytes of the body read, whatever its Content-Length.
+func (b *Work) send(c *http.Client, req *http.Request, s time.Duration, read func(resp *http.Response) (string, int64, error)) *result {
 	var size int64
 	var code int
 	var dnsStart, connStart, resStart, reqStart, delayStart time.Duration
 	var dnsDuration, connDuration, resDuration, reqDuration, delayDuration time.Duration
-	var req *http.Request
-	if b.RequestFunc != nil {
-		req = b.RequestFunc()
-	} else {
-		req = cloneRequest(b.Request, b.RequestBody)
+	var u string
+	if b.ResultLog != nil {
+		u = req.URL.String()
 	}
 	trace := &httptrace.ClientTrace{
 		DNSStart: func(info httptrace.DNSStartInfo) {
@@ -167,7 +576,9 @@ func (b *Work) makeRequest(c *http.Client) {
 			connStart = now()
 		},
 		GotConn: func(connInfo httptrace.GotConnInfo) {
-			if !connInfo.Reused {
+			if connInfo.Reused {
+				atomic.AddInt64(&b.conns.reused, 1)
+			} else {
 				connDuration = now() - connStart
 			}
 			reqStart = now()
@@ -181,66 +592,376 @@ func (b *Work) makeRequest(c *http.Client) {
 			resStart = now()
 		},
 	}
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	ctx := &requestContext{Context: b.ctx, values: req.Context()}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
 	resp, err := c.Do(req)
+	if err != nil {
+		err = classifyTLS(err)
+	}
+	var failure string
 	if err == nil {
-		size = resp.ContentLength
 		code = resp.StatusCode
-		io.Copy(ioutil.Discard, resp.Body)
+		switch {
+		case read != nil:
+			failure, size, err = read(resp)
+		case b.Expect != nil:
+			failure, size, err = b.Expect.check(resp)
+		default:
+			size, err = io.Copy(ioutil.Discard, resp.Body)
+		}
 		resp.Body.Close()
 	}
 	t := now()
 	resDuration = t - resStart
 	finish := t - s
-	b.results <- &result{
-		offset:        s,
+	if err != nil && b.ctx.Err() != nil {
+		return &result{offset: s - b.start, duration: finish, cancelled: true, url: u}
+	}
+	return &result{
+		offset:        s - b.start,
 		statusCode:    code,
 		duration:      finish,
 		err:           err,
+		failure:       failure,
 		contentLength: size,
 		connDuration:  connDuration,
 		dnsDuration:   dnsDuration,
 		reqDuration:   reqDuration,
 		resDuration:   resDuration,
 		delayDuration: delayDuration,
+		url:           u,
 	}
 }
 
-func (b *Work) runWorker(client *http.Client, n int) {
-	var throttle <-chan time.Time
-	if b.QPS > 0 {
-		throttle = time.Tick(time.Duration(1e6/(b.QPS)) * time.Microsecond)
+// requestContext is the context requests are sent with. It is cancelled
+// with the run, but has the values of the context of the request too,
+// such as its label.
+type requestContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c *requestContext) Value(key interface{}) interface{} {
+	if v := c.values.Value(key); v != nil {
+		return v
 	}
+	return c.Context.Value(key)
+}
+
+// errNoMoreRequests is returned by newRequest when RequestFunc or Feeder
+// have no more requests to give.
+var errNoMoreRequests = errors.New("requester: no more requests")
 
-	if b.DisableRedirects {
-		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
+type labelKey struct{}
+
+// WithLabel returns a shallow copy of req labeled with label. The results
+// of labeled requests are reported for each label as well as in total.
+func WithLabel(req *http.Request, label string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), labelKey{}, label))
+}
+
+// newRequest returns the nth request to send, from the given worker, and
+// the label it is reported under, if any. i is the number of the
+// scheduled request, which is the target sent when replaying.
+func (b *Work) newRequest(n int64, worker, i int) (*http.Request, string, error) {
+	if b.RequestFunc != nil {
+		req := b.RequestFunc()
+		if req == nil {
+			return nil, "", errNoMoreRequests
+		}
+		label, _ := req.Context().Value(labelKey{}).(string)
+		return req, label, nil
+	}
+	var row map[string]string
+	if b.Feeder != nil {
+		var ok bool
+		if row, ok = b.Feeder.Next(); !ok {
+			return nil, "", errNoMoreRequests
+		}
+	}
+	if b.picker != nil {
+		var t *preparedTarget
+		label := ""
+		if b.Replay {
+			t = &b.picker.targets[i]
+		} else {
+			t = b.picker.pick(worker)
+			label = t.label
 		}
+		if t.err != nil {
+			return nil, label, t.err
+		}
+		if t.tmpl != nil {
+			return t.tmpl.execute(b.vars(n, worker, row)), label, nil
+		}
+		return cloneRequest(t.req, t.body), label, nil
+	}
+	if b.tmpl != nil {
+		return b.tmpl.execute(b.vars(n, worker, row)), "", nil
+	}
+	return cloneRequest(b.Request, b.RequestBody), "", nil
+}
+
+func (b *Work) vars(n int64, worker int, row map[string]string) *tmplVars {
+	return &tmplVars{seq: n, worker: worker, rnd: b.rands[worker], row: row}
+}
+
+// templated reports whether requests are built from templates.
+func (b *Work) templated() bool {
+	return b.Templated || b.Feeder != nil || b.Scenario != nil
+}
+
+func (b *Work) runWorker(client *http.Client, n, worker int) {
+	var throttle <-chan time.Time
+	if b.QPS > 0 && !b.GlobalQPS {
+		throttle = time.Tick(time.Duration(1e6/(b.QPS)) * time.Microsecond)
 	}
+
 	for i := 0; i < n; i++ {
 		// Check if application is stopped. Do not send into a closed channel.
 		select {
-		case <-b.stopCh:
+		case <-b.ctx.Done():
 			return
 		default:
-			if b.QPS > 0 {
-				<-throttle
+		}
+		if throttle != nil {
+			select {
+			case <-throttle:
+			case <-b.ctx.Done():
+				return
 			}
-			b.makeRequest(client)
+		} else if b.limiter != nil && !b.limiter.wait(b.ctx.Done()) {
+			return
 		}
+		if b.KeepTiming && b.picker != nil && b.picker.pos != nil && !b.picker.wait(worker, b.ctx.Done()) {
+			return
+		}
+		if !b.do(client, now(), worker, -1) {
+			return
+		}
+	}
+}
+
+// runOpenLoop hands out requests to the workers as they become free, at
+// the times given by next, which returns the due time of the ith request
+// relative to the start of the loop, or false when there are no more.
+// The schedule does not depend on the responses, so a slow server delays
+// requests rather than reducing the number of them, and that delay shows
+// up in the reported latencies.
+func (b *Work) runOpenLoop(clients []*http.Client, next func(i int) (time.Duration, bool)) {
+	var wg sync.WaitGroup
+	wg.Add(b.C)
+
+	type job struct {
+		at time.Duration
+		i  int
+	}
+	jobs := make(chan job)
+	quit := make(chan struct{})
+	go func() {
+		defer close(jobs)
+		start := now()
+		for i := 0; ; i++ {
+			d, ok := next(i)
+			if !ok {
+				return
+			}
+			at := start + d
+			if d := at - now(); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-quit:
+					t.Stop()
+					return
+				}
+			}
+			select {
+			case jobs <- job{at, i}:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < b.C; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-b.ctx.Done():
+					return
+				case j, ok := <-jobs:
+					if !ok {
+						return
+					}
+					if !b.do(clients[i], j.at, i, j.i) {
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(quit)
+}
+
+// runStages runs a concurrency profile. Every worker the profile needs at
+// its peak is started up front, and the ith worker only sends requests
+// while the current target is above i.
+func (b *Work) runStages(clients []*http.Client, p profile) {
+	var wg sync.WaitGroup
+	wg.Add(p.maxC())
+
+	start := now()
+	for i := 0; i < p.maxC(); i++ {
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-b.ctx.Done():
+					return
+				default:
+				}
+				t := now() - start
+				if t >= p.duration() {
+					return
+				}
+				if float64(i) < math.Round(p.level(t)) {
+					if !b.do(clients[i], now(), i, -1) {
+						return
+					}
+				} else {
+					select {
+					case <-time.After(stageTick):
+					case <-b.ctx.Done():
+						return
+					}
+				}
+			}
+		}(i)
 	}
+	wg.Wait()
 }
 
 func (b *Work) runWorkers() {
+	clients := b.newClients()
+
+	if b.Replay {
+		b.runOpenLoop(clients, func(i int) (time.Duration, bool) {
+			if i >= len(b.Targets) {
+				return 0, false
+			}
+			return b.replayAt(i), true
+		})
+		return
+	}
+	if p := profile(b.Stages); len(p) > 0 {
+		if p.isRate() {
+			b.runOpenLoop(clients, func(i int) (time.Duration, bool) {
+				return p.arrival(i)
+			})
+		} else {
+			b.runStages(clients, p)
+		}
+		return
+	}
+	if b.Rate > 0 {
+		b.runOpenLoop(clients, func(i int) (time.Duration, bool) {
+			return time.Duration(float64(i) * float64(time.Second) / b.Rate), i < b.N
+		})
+		return
+	}
+
+	if b.QPS > 0 && b.GlobalQPS {
+		b.limiter = newLimiter(b.QPS)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(b.C)
 
+	// Ignore the case where b.N % b.C != 0.
+	for i := 0; i < b.C; i++ {
+		go func(i int) {
+			b.runWorker(clients[i], b.N/b.C, i)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
+
+// newClients returns the client of each worker. The workers share a
+// client, and so its connections, unless they have cookie jars or
+// connections of their own, or share a fixed number of connections.
+func (b *Work) newClients() []*http.Client {
+	pools := 1
+	switch {
+	case b.WorkerConnections:
+		pools = b.workers()
+	case b.Connections > 0:
+		pools = min(b.Connections, b.workers())
+	}
+	transports := make([]*http.Transport, pools)
+	for i := range transports {
+		transports[i] = b.newTransport()
+	}
+	clients := make([]*http.Client, b.workers())
+	for i := range clients {
+		if i >= pools && !b.CookieJars {
+			clients[i] = clients[i%pools]
+			continue
+		}
+		client := &http.Client{Transport: transports[i%pools], Timeout: time.Duration(b.Timeout) * time.Second}
+		if b.DisableRedirects {
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+		}
+		if b.CookieJars {
+			// cookiejar.New never fails.
+			client.Jar, _ = cookiejar.New(nil)
+		}
+		clients[i] = client
+	}
+	return clients
+}
+
+func (b *Work) newTransport() *http.Transport {
+	var serverName string
+	if b.Request != nil {
+		serverName = b.Request.Host
+		if host, _, err := net.SplitHostPort(serverName); err == nil {
+			serverName = host
+		}
+	}
+	idle := min(b.workers(), maxIdleConn)
+	var maxConns int
+	if b.WorkerConnections || b.Connections > 0 {
+		// A worker has a single request in flight at a time, and a fixed
+		// connection is one per pool.
+		idle = 1
+	}
+	if b.Connections > 0 && !b.WorkerConnections {
+		maxConns = 1
+	}
+	if b.MaxConnsPerHost > 0 {
+		idle = min(idle, b.MaxConnsPerHost)
+		if maxConns == 0 {
+			maxConns = b.MaxConnsPerHost
+		}
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if b.TLSConfig != nil {
+		tlsConfig = b.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         b.Request.Host,
-		},
-		MaxIdleConnsPerHost: min(b.C, maxIdleConn),
+		TLSClientConfig:     tlsConfig,
+		DialContext:         b.conns.dial,
+		MaxIdleConnsPerHost: idle,
+		MaxConnsPerHost:     maxConns,
 		DisableCompression:  b.DisableCompression,
 		DisableKeepAlives:   b.DisableKeepAlives,
 		Proxy:               http.ProxyURL(b.ProxyAddr),
@@ -250,16 +971,7 @@ func (b *Work) runWorkers() {
 	} else {
 		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
-	client := &http.Client{Transport: tr, Timeout: time.Duration(b.Timeout) * time.Second}
-
-	// Ignore the case where b.N % b.C != 0.
-	for i := 0; i < b.C; i++ {
-		go func() {
-			b.runWorker(client, b.N/b.C)
-			wg.Done()
-		}()
-	}
-	wg.Wait()
+	return tr
 }
 
 // cloneRequest returns a clone of the provided *http.Request.
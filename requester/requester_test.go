@@ -16,9 +16,22 @@ package requester
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -72,6 +85,106 @@ func TestQps(t *testing.T) {
 	wg.Wait()
 }
 
+func TestGlobalQps(t *testing.T) {
+	var wg sync.WaitGroup
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, int64(1))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request:   req,
+		N:         20,
+		C:         4,
+		QPS:       2,
+		GlobalQPS: true,
+	}
+	wg.Add(1)
+	time.AfterFunc(time.Second, func() {
+		if n := atomic.LoadInt64(&count); n > 3 {
+			t.Errorf("Expected to work at most 3 times, found %v", n)
+		}
+		wg.Done()
+	})
+	go w.Run()
+	wg.Wait()
+}
+
+func TestRate(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, int64(1))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request: req,
+		N:       5,
+		C:       5,
+		Rate:    10,
+		Writer:  ioutil.Discard,
+	}
+	start := time.Now()
+	w.Run()
+	if count != 5 {
+		t.Errorf("Expected to send 5 requests, found %v", count)
+	}
+	// The last request is scheduled 400ms after the first one.
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("Expected the run to take at least 400ms, took %v", d)
+	}
+}
+
+func TestStages(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, int64(1))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var buf bytes.Buffer
+	w := &Work{
+		Request: req,
+		C:       1,
+		Stages: []Stage{
+			{Duration: 200 * time.Millisecond, Rate: 50},
+			{Duration: 200 * time.Millisecond, Rate: 50},
+		},
+		Writer: &buf,
+	}
+	w.Run()
+	// 5 requests during the ramp up and 10 while holding the rate.
+	if count < 14 || count > 16 {
+		t.Errorf("Expected to send 15 requests, found %v", count)
+	}
+	for _, name := range []string{"Stage 1 (ramp from 0 to 50 req/s over 200ms)", "Stage 2 (hold 50 req/s for 200ms)"} {
+		if !bytes.Contains(buf.Bytes(), []byte(name)) {
+			t.Errorf("Expected the report to contain %q", name)
+		}
+	}
+}
+
+func TestStagesIdleConns(t *testing.T) {
+	// Connections are kept for the peak concurrency, not for C.
+	w := &Work{
+		C: 1,
+		Stages: []Stage{
+			{Duration: time.Second, C: 20},
+			{Duration: time.Second, C: 5},
+		},
+	}
+	if got := w.newTransport().MaxIdleConnsPerHost; got != 20 {
+		t.Errorf("Expected 20 idle connections, found %d", got)
+	}
+}
+
 func TestRequest(t *testing.T) {
 	var uri, contentType, some, auth string
 	handler := func(w http.ResponseWriter, r *http.Request) {
@@ -132,3 +245,1265 @@ func TestBody(t *testing.T) {
 		t.Errorf("Expected to work 10 times, found %v", count)
 	}
 }
+
+func TestSearch(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Load") == "high" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	s := &Search{
+		NewWork: func() *Work {
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			return &Work{Request: req, C: 1}
+		},
+		Rate:         true,
+		Start:        10,
+		Step:         10,
+		Max:          30,
+		Window:       200 * time.Millisecond,
+		P99:          time.Second,
+		MaxErrorRate: 0.01,
+		Writer:       ioutil.Discard,
+	}
+	res := s.Run()
+	if got, want := len(res.Levels), 3; got != want {
+		t.Fatalf("Expected %v levels to be tried, found %v", want, got)
+	}
+	if res.Best == nil || res.Best.Level != 30 {
+		t.Errorf("Expected the best level to be 30, found %+v", res.Best)
+	}
+
+	// Fail every level with 5xx responses.
+	s.NewWork = func() *Work {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("X-Load", "high")
+		return &Work{Request: req, C: 1}
+	}
+	res = s.Run()
+	if len(res.Levels) != 1 || res.Best != nil {
+		t.Errorf("Expected the search to stop at the first level, found %+v", res.Levels)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		paths[r.Method+" "+r.URL.Path+" "+string(body)]++
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	w := &Work{
+		Targets: []*Target{
+			{URL: server.URL + "/a", Label: "first"},
+			{Method: "POST", URL: server.URL + "/b%20c", Body: []byte("Body")},
+		},
+		N:      10,
+		C:      2,
+		Writer: &buf,
+	}
+	w.Run()
+	if got := paths["GET /a "]; got != 5 {
+		t.Errorf("Expected to send 5 requests to /a, found %v", got)
+	}
+	if got := paths["POST /b c Body"]; got != 5 {
+		t.Errorf("Expected to send 5 requests to /b c, found %v", got)
+	}
+	// Labels are printed as they are, even with a %.
+	for _, label := range []string{"first:", "POST " + server.URL + "/b%20c:", "\n  50% in "} {
+		if !bytes.Contains(buf.Bytes(), []byte(label)) {
+			t.Errorf("Expected the report to contain %q", label)
+		}
+	}
+}
+
+func TestLoadTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "body.json"), []byte(`{"id":1}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "targets"), []byte(`# comment
+{"url": "http://localhost/a", "weight": 3}
+
+{"method": "PUT", "url": "http://localhost/b", "headers": {"X-Some": "value"}, "body_file": "body.json", "label": "put"}
+`), 0644)
+
+	targets, err := LoadTargets(filepath.Join(dir, "targets"))
+	if err != nil {
+		t.Fatalf("LoadTargets errored: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, found %v", len(targets))
+	}
+	if got, want := targets[0].label(), "GET http://localhost/a"; got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if got, want := targets[0].Weight, 3; got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	b := targets[1]
+	if b.Method != "PUT" || b.Label != "put" || b.Header.Get("X-Some") != "value" || string(b.Body) != `{"id":1}` {
+		t.Errorf("Unexpected target: %+v", b)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "bad"), []byte(`{"method": "GET"}`), 0644)
+	if _, err := LoadTargets(filepath.Join(dir, "bad")); err == nil {
+		t.Errorf("Expected a target without url to error")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var i int64
+	var buf bytes.Buffer
+	w := &Work{
+		RequestFunc: func() *http.Request {
+			if atomic.AddInt64(&i, 1)%2 == 0 {
+				req, _ := http.NewRequest("GET", server.URL+"/missing", nil)
+				return WithLabel(req, "missing")
+			}
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			return WithLabel(req, "root")
+		},
+		N:      10,
+		C:      1,
+		Output: "{{ range .Labels }}{{ .Name }} {{ .NumRes }} {{ range $code, $num := .StatusCodeDist }}[{{ $code }}] {{ $num }}{{ end }}\n{{ end }}",
+		Writer: &buf,
+	}
+	w.Run()
+	if got, want := buf.String(), "missing 5 [404] 5\nroot 5 [200] 5\n\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var buf bytes.Buffer
+	w := &Work{
+		Request: req,
+		N:       10,
+		C:       2,
+		Output:  "json",
+		Writer:  &buf,
+	}
+	w.Run()
+
+	var rep JSONReport
+	if err := json.Unmarshal(buf.Bytes(), &rep); err != nil {
+		t.Fatalf("Output is not valid JSON: %v", err)
+	}
+	if rep.SchemaVersion != JSONSchemaVersion {
+		t.Errorf("Expected schema version %v, found %v", JSONSchemaVersion, rep.SchemaVersion)
+	}
+	if rep.NumRes != 10 || rep.StatusCodeDist["200"] != 10 || rep.SizeTotal != 50 {
+		t.Errorf("Unexpected results: %+v", rep)
+	}
+	if rep.Config.URL != server.URL || rep.Config.N != 10 || rep.Config.C != 2 {
+		t.Errorf("Unexpected config: %+v", rep.Config)
+	}
+	if len(rep.LatencyDistribution) == 0 || len(rep.Histogram) == 0 {
+		t.Errorf("Expected latency distribution and histogram, found %+v", rep)
+	}
+}
+
+func TestResultLog(t *testing.T) {
+	// The body is chunked, so its length is only known once it is read.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(" world"))
+	}))
+	defer server.Close()
+
+	for _, expect := range []*Expect{nil, {StatusCodes: []int{200}}} {
+		var log bytes.Buffer
+		w := &Work{
+			Targets: []*Target{
+				{URL: server.URL, Label: "ok"},
+				{URL: "http://127.0.0.1:1", Label: "refused"},
+			},
+			N:         4,
+			C:         1,
+			Writer:    ioutil.Discard,
+			ResultLog: &log,
+			Expect:    expect,
+		}
+		w.Run()
+
+		dec := json.NewDecoder(&log)
+		counts := make(map[string]int)
+		for dec.More() {
+			var res JSONResult
+			if err := dec.Decode(&res); err != nil {
+				t.Fatalf("Result log is not valid JSON: %v", err)
+			}
+			switch {
+			case res.Label == "ok" && res.Status == 200 && res.Error == "" && res.URL == server.URL && res.Bytes == 11:
+				counts["ok"]++
+			case res.Label == "refused" && res.Status == 0 && res.Error != "":
+				counts["refused"]++
+			default:
+				t.Errorf("Unexpected result: %+v", res)
+			}
+		}
+		if counts["ok"] != 2 || counts["refused"] != 2 {
+			t.Errorf("Expected 2 successful and 2 failed results, found %v", counts)
+		}
+	}
+}
+
+// notifyWriter closes c on its first write.
+type notifyWriter struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.c) })
+	return len(p), nil
+}
+
+func TestResultLogFlush(t *testing.T) {
+	defer func(d time.Duration) { resultLogFlush = d }(resultLogFlush)
+	resultLogFlush = 10 * time.Millisecond
+
+	log := &notifyWriter{c: make(chan struct{})}
+	var count int64
+	flushed := false
+	// The last request waits for the first result to be written.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&count, 1) == 2 {
+			select {
+			case <-log.c:
+				flushed = true
+			case <-time.After(2 * time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Request: req, N: 2, C: 1, ResultLog: log}
+	if _, err := w.RunContext(context.Background()); err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if !flushed {
+		t.Errorf("Expected the result log to be flushed during the run")
+	}
+}
+
+func TestHDRHistogram(t *testing.T) {
+	h := newHDRHistogram(3)
+	for i := 1; i <= 100000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	if h.min != time.Microsecond || h.max != 100*time.Millisecond {
+		t.Errorf("Expected min 1µs and max 100ms, found %v and %v", h.min, h.max)
+	}
+	if got, want := h.mean(), 50000500*time.Nanosecond; got != want {
+		t.Errorf("Expected mean %v, found %v", want, got)
+	}
+	for _, p := range []float64{10, 50, 99, 99.9, 99.99} {
+		want := time.Duration(p * 1000 * float64(time.Microsecond))
+		got := h.percentile(p)
+		if diff := got - want; diff < 0 || float64(diff) > float64(want)/1000 {
+			t.Errorf("p%v: got %v; want %v within 0.1%%", p, got, want)
+		}
+	}
+	for _, d := range h.latencies() {
+		if d.Percentage != int(d.Percentile) {
+			t.Errorf("Expected percentage %d for percentile %v", int(d.Percentile), d.Percentile)
+		}
+	}
+	var count int
+	for _, b := range h.buckets() {
+		count += b.Count
+	}
+	if count != 100000 {
+		t.Errorf("Expected histogram buckets to hold 100000 values, found %v", count)
+	}
+	// A minute takes about 10MB at the highest precision, and 140KB at
+	// the default one.
+	for precision, want := range map[int]int{5: 10 * 131072, 3: 17 * 1024} {
+		h := newHDRHistogram(precision)
+		h.record(time.Minute)
+		if len(h.counts) != want {
+			t.Errorf("Expected %d counts for a minute at precision %d, found %d", want, precision, len(h.counts))
+		}
+	}
+	// Memory depends on the largest value only.
+	n := len(h.counts)
+	for i := 0; i < 100000; i++ {
+		h.record(time.Millisecond)
+	}
+	if len(h.counts) != n {
+		t.Errorf("Expected counts not to grow, grew from %v to %v", n, len(h.counts))
+	}
+}
+
+func TestExpect(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt64(&count, 1)%2 == 0 {
+			w.Write([]byte(`{"data": {"items": [{"id": 7}]}, "status": "ok"}`))
+			return
+		}
+		w.Write([]byte(`{"status": "degraded"}`))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var buf bytes.Buffer
+	w := &Work{
+		Request: req,
+		N:       10,
+		C:       1,
+		Output:  "json",
+		Writer:  &buf,
+		Expect: &Expect{
+			StatusCodes: []int{200},
+			Headers:     map[string]*regexp.Regexp{"content-type": regexp.MustCompile("^application/json")},
+			Body:        regexp.MustCompile(`"status"`),
+			JSON: []JSONCheck{
+				{Path: "data.items[0].id", Value: "7"},
+				{Path: "status", Value: "ok"},
+			},
+		},
+	}
+	w.Run()
+
+	var rep JSONReport
+	if err := json.Unmarshal(buf.Bytes(), &rep); err != nil {
+		t.Fatalf("Output is not valid JSON: %v", err)
+	}
+	// Failures are counted by status code too, but not in the latencies.
+	if rep.NumRes != 10 || rep.StatusCodeDist["200"] != 10 {
+		t.Errorf("Expected 10 responses, found %v", rep.StatusCodeDist)
+	}
+	if got := rep.FailureDist["JSON field data.items[0].id is missing"]; got != 5 {
+		t.Errorf("Expected 5 failures, found %v", rep.FailureDist)
+	}
+	var n int
+	for _, b := range rep.Histogram {
+		n += b.Count
+	}
+	if n != 5 {
+		t.Errorf("Expected the latencies of 5 successful responses, found %d", n)
+	}
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	th, _ := ParseThreshold("5xx==0")
+	w = &Work{Request: req, N: 4, C: 1, Expect: &Expect{StatusCodes: []int{200}}, Thresholds: []Threshold{th}, Writer: ioutil.Discard}
+	r, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if r.StatusCodeDist[500] != 4 || r.FailureDist["unexpected status code 500"] != 4 {
+		t.Errorf("Expected 4 failed 500 responses, found %v and %v", r.StatusCodeDist, r.FailureDist)
+	}
+	if r.Passed() {
+		t.Errorf("Expected 5xx==0 to fail with 500 responses that do not match Expect")
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&count, 1) > 8 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var thresholds []Threshold
+	for _, s := range []string{"p99 < 10s", "error_rate<1%", "rps>=1", "5xx==0", "2xx >= 8"} {
+		th, err := ParseThreshold(s)
+		if err != nil {
+			t.Fatalf("ParseThreshold(%q) failed: %v", s, err)
+		}
+		thresholds = append(thresholds, th)
+	}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var buf bytes.Buffer
+	w := &Work{
+		Request:    req,
+		N:          10,
+		C:          1,
+		Output:     "json",
+		Writer:     &buf,
+		Thresholds: thresholds,
+	}
+	w.Run()
+	if w.Passed() {
+		t.Errorf("Expected the run to fail its thresholds")
+	}
+
+	var rep JSONReport
+	if err := json.Unmarshal(buf.Bytes(), &rep); err != nil {
+		t.Fatalf("Output is not valid JSON: %v", err)
+	}
+	if rep.Passed || len(rep.Thresholds) != len(thresholds) {
+		t.Fatalf("Unexpected thresholds: %+v", rep.Thresholds)
+	}
+	for i, want := range []bool{true, false, true, false, true} {
+		if rep.Thresholds[i].Pass != want {
+			t.Errorf("Expected %v to pass: %v, found %+v", thresholds[i], want, rep.Thresholds[i])
+		}
+	}
+
+	// Every request fails, so there are no latencies to meet the
+	// thresholds with.
+	server.Close()
+	thresholds = nil
+	for _, s := range []string{"p95<200ms", "avg<1s", "fastest<1s", "slowest<1s", "error_rate<=1"} {
+		th, err := ParseThreshold(s)
+		if err != nil {
+			t.Fatalf("ParseThreshold(%q) failed: %v", s, err)
+		}
+		thresholds = append(thresholds, th)
+	}
+	buf.Reset()
+	w = &Work{Request: req, N: 4, C: 1, Output: "json", Writer: &buf, Thresholds: thresholds}
+	w.Run()
+	if w.Passed() {
+		t.Errorf("Expected the run to fail its thresholds when every request errors")
+	}
+	rep = JSONReport{}
+	if err := json.Unmarshal(buf.Bytes(), &rep); err != nil {
+		t.Fatalf("Output is not valid JSON: %v", err)
+	}
+	for i, th := range rep.Thresholds {
+		want := i < 4 // the latencies have no value
+		if th.Pass != !want || (th.Actual == nil) != want {
+			t.Errorf("Unexpected outcome of %v with every request failing: %+v", thresholds[i], th)
+		}
+	}
+
+	for _, s := range []string{"p97<1s", "foo<1", "p95", "rps>fast"} {
+		if _, err := ParseThreshold(s); err == nil {
+			t.Errorf("Expected an error for threshold %q", s)
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var buf bytes.Buffer
+	w := &Work{
+		Request:    req,
+		N:          20,
+		C:          2,
+		Writer:     &buf,
+		RawSamples: true,
+	}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("Expected nothing to be printed, found %q", buf.String())
+	}
+	if rep.NumRes != 20 || rep.StatusCodeDist[200] != 20 || len(rep.Lats) != 20 {
+		t.Errorf("Unexpected report: %+v", rep)
+	}
+	if err := rep.Print(&buf, "csv"); err != nil {
+		t.Fatalf("Print failed: %v", err)
+	}
+	if lines := strings.Count(strings.TrimSpace(buf.String()), "\n"); lines != 20 {
+		t.Errorf("Expected 20 CSV records, found %d", lines)
+	}
+	if err := rep.Print(&buf, "{{ .Invalid"); err == nil {
+		t.Errorf("Expected an error for an invalid template")
+	}
+	// The summary and custom templates print % signs once.
+	buf.Reset()
+	if err := rep.Print(&buf, ""); err != nil {
+		t.Fatalf("Print failed: %v", err)
+	}
+	if out := buf.String(); !strings.Contains(out, "\n  50% in ") || !strings.Contains(out, "Details (50%, 99%, 99.9% in)") || strings.Contains(out, "%%") {
+		t.Errorf("Unexpected %% signs in the summary: %q", out)
+	}
+	buf.Reset()
+	if err := rep.Print(&buf, "{{ .NumRes }}%% {{ len .Lats }}%"); err != nil {
+		t.Fatalf("Print failed: %v", err)
+	}
+	if got := buf.String(); got != "20% 20%\n" {
+		t.Errorf("Expected a custom template to print %q, found %q", "20% 20%\n", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w = &Work{Request: req, N: math.MaxInt32, C: 2}
+	rep, err = w.RunContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, found %v", context.DeadlineExceeded, err)
+	}
+	if rep == nil || rep.NumRes == 0 {
+		t.Errorf("Expected the results of the requests made, found %+v", rep)
+	}
+
+	if _, err := (&Work{C: 1, N: 1}).RunContext(context.Background()); err == nil {
+		t.Errorf("Expected an error for a run without a request")
+	}
+}
+
+func TestBodyErrors(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/reset" {
+			// Cut the response off before the rest of the chunked body.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		<-r.Context().Done()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	// Requests stopped while reading the body are cancelled.
+	req, _ := http.NewRequest("GET", server.URL+"/slow", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := &Work{Request: req, N: 10, C: 2}
+	rep, _ := w.RunContext(ctx)
+	if rep.Cancelled != 2 || rep.NumRes != 0 {
+		t.Errorf("Expected 2 cancelled requests, found %d cancelled and %d results", rep.Cancelled, rep.NumRes)
+	}
+
+	// Bodies cut off are errors.
+	req, _ = http.NewRequest("GET", server.URL+"/reset", nil)
+	w = &Work{Request: req, N: 4, C: 1}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if sum(rep.ErrorDist) != 4 || len(rep.StatusCodeDist) != 0 {
+		t.Errorf("Expected 4 errors, found %v and %v", rep.ErrorDist, rep.StatusCodeDist)
+	}
+}
+
+func TestStop(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/slow", nil)
+	w := &Work{Request: req, N: 10, C: 2}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w.Stop()
+		w.Stop()
+	}()
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if rep.Cancelled != 2 || rep.NumRes != 0 || len(rep.ErrorDist) != 0 {
+		t.Errorf("Expected 2 cancelled requests and no errors, found %+v", rep)
+	}
+	w.Stop()
+
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	stopped := &Work{Request: req, N: 10, C: 2}
+	stopped.Stop()
+	if rep, _ := stopped.RunContext(context.Background()); rep.NumRes != 0 {
+		t.Errorf("Expected no requests after Stop, found %v", rep.NumRes)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	var progress bytes.Buffer
+	w := &Work{
+		Request:          req,
+		N:                math.MaxInt32,
+		C:                2,
+		Writer:           ioutil.Discard,
+		Progress:         &progress,
+		ProgressInterval: 50 * time.Millisecond,
+		ProgressLines:    true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 280*time.Millisecond)
+	defer cancel()
+	w.RunContext(ctx)
+
+	lines := strings.Split(strings.TrimSpace(progress.String()), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("Expected at least 3 progress lines, found %q", progress.String())
+	}
+	for _, l := range lines {
+		if !strings.Contains(l, " requests, ") || !strings.Contains(l, "2xx: ") {
+			t.Errorf("Unexpected progress line %q", l)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Request: req,
+		N:       math.MaxInt32,
+		C:       2,
+		Window:  50 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 220*time.Millisecond)
+	defer cancel()
+	rep, _ := w.RunContext(ctx)
+
+	if len(rep.Windows) != 5 {
+		t.Fatalf("Expected 5 windows, found %d", len(rep.Windows))
+	}
+	var n int64
+	for i, win := range rep.Windows {
+		if win.Start != time.Duration(i)*w.Window {
+			t.Errorf("Expected window %d to start at %v, found %v", i, time.Duration(i)*w.Window, win.Start)
+		}
+		n += win.NumRes
+	}
+	if n != rep.NumRes {
+		t.Errorf("Expected the windows to have %d results, found %d", rep.NumRes, n)
+	}
+	var buf bytes.Buffer
+	if err := rep.PrintWindows(&buf, "csv"); err != nil {
+		t.Fatalf("PrintWindows failed: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 6 {
+		t.Errorf("Expected a header and 5 CSV records, found %q", buf.String())
+	}
+
+	// Windows are closed once their requests can no longer be in flight.
+	ws := newWindows(time.Second, time.Second, defaultPrecision)
+	ws.add(&result{offset: 0}, 0)
+	ws.add(&result{offset: 5 * time.Second}, 5100*time.Millisecond)
+	if len(ws.closed) != 4 || len(ws.open) != 2 || ws.first != 4 {
+		t.Errorf("Expected 4 closed and 2 open windows, found %d and %d", len(ws.closed), len(ws.open))
+	}
+	ws.add(&result{offset: 500 * time.Millisecond}, 5200*time.Millisecond)
+	if ws.late != 1 || len(ws.open) != 2 {
+		t.Errorf("Expected a late result and 2 open windows, found %d and %d", ws.late, len(ws.open))
+	}
+
+	// Without a timeout, windows are still closed, two windows after they
+	// end.
+	ws = newWindows(time.Second, 0, defaultPrecision)
+	for i := 0; i < 100; i++ {
+		ws.add(&result{offset: time.Duration(i) * time.Second}, time.Duration(i)*time.Second+100*time.Millisecond)
+	}
+	if len(ws.open) > 3 || len(ws.closed) < 97 {
+		t.Errorf("Expected at most 3 open windows without a timeout, found %d open and %d closed", len(ws.open), len(ws.closed))
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Request: req, N: 20, C: 1, WarmUpRequests: 5}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if rep.NumRes != 15 || rep.WarmUp == nil || rep.WarmUp.NumRes != 5 {
+		t.Errorf("Expected 15 results and 5 warm-up results, found %+v", rep)
+	}
+
+	w = &Work{
+		Request:    req,
+		N:          math.MaxInt32,
+		C:          2,
+		WarmUp:     100 * time.Millisecond,
+		RawSamples: true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	rep, _ = w.RunContext(ctx)
+	if rep.WarmUp == nil || rep.WarmUp.NumRes == 0 || rep.NumRes == 0 {
+		t.Fatalf("Expected results both during and after the warm-up, found %+v", rep)
+	}
+	if rep.Total > 200*time.Millisecond {
+		t.Errorf("Expected the run to be measured after the warm-up, found a total of %v", rep.Total)
+	}
+	for _, off := range rep.Offsets {
+		if off < w.WarmUp.Seconds() {
+			t.Errorf("Found a result started at %v, during the warm-up", off)
+			break
+		}
+	}
+}
+
+func TestTemplated(t *testing.T) {
+	var mu sync.Mutex
+	var paths, ids, bodies []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		ids = append(ids, r.Header.Get("X-Id"))
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/items/{{seq}}?w={{worker}}&n={{randInt 5 5}}", nil)
+	req.Header.Set("X-Id", "{{uuid}}")
+	w := &Work{
+		Request:     req,
+		RequestBody: []byte(`{"name": "{{randString 4}}"}`),
+		N:           3,
+		C:           1,
+		Templated:   true,
+	}
+	if _, err := w.RunContext(context.Background()); err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	for i, p := range paths {
+		if want := fmt.Sprintf("/items/%d?w=0&n=5", i+1); p != want {
+			t.Errorf("Expected %v, found %v", want, p)
+		}
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, id := range ids {
+		if !uuid.MatchString(id) {
+			t.Errorf("Expected a UUID, found %q", id)
+		}
+	}
+	for _, b := range bodies {
+		if !regexp.MustCompile(`^{"name": "[a-zA-Z0-9]{4}"}$`).MatchString(b) {
+			t.Errorf("Unexpected body %q", b)
+		}
+	}
+
+	for _, s := range []string{"/{{nope}}", "/{{seq", "/{{randInt 5 1}}", "/{{randString}}"} {
+		req, _ := http.NewRequest("GET", server.URL+s, nil)
+		w := &Work{Request: req, N: 1, C: 1, Templated: true}
+		if _, err := w.RunContext(context.Background()); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+
+	// Run logs the error rather than sending the placeholder as is.
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	mu.Lock()
+	paths = nil
+	mu.Unlock()
+	req, _ = http.NewRequest("GET", server.URL+"/{{bogus}}", nil)
+	w = &Work{Request: req, N: 1, C: 1, Templated: true, Writer: ioutil.Discard}
+	w.Run()
+	if len(paths) != 0 || !strings.Contains(logs.String(), "bogus") {
+		t.Errorf("Expected Run to log the error and send nothing, found %q and log %q", paths, logs.String())
+	}
+}
+
+func TestFeeder(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, r.URL.Query().Get("q")+"|"+r.Header.Get("X-User")+"|"+string(body))
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.csv")
+	if err := ioutil.WriteFile(path, []byte("user,term\nann,red shoes\nbob,blue\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	feeder, err := LoadFeeder(path, "unique")
+	if err != nil {
+		t.Fatalf("LoadFeeder failed: %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/?q={{data.term}}", nil)
+	req.Header.Set("X-User", "{{data.user}}")
+	w := &Work{
+		Request:     req,
+		RequestBody: []byte("{{data.user}}"),
+		N:           10,
+		C:           1,
+		Feeder:      feeder,
+	}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if rep.NumRes != 2 {
+		t.Errorf("Expected the run to stop after 2 requests, found %d", rep.NumRes)
+	}
+	want := []string{"red shoes|ann|ann", "blue|bob|bob"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected requests %q, found %q", want, got)
+	}
+
+	path = filepath.Join(dir, "data.jsonl")
+	if err := ioutil.WriteFile(path, []byte("{\"id\": 1}\n{\"id\": 2}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if feeder, err = LoadFeeder(path, ""); err != nil {
+		t.Fatalf("LoadFeeder failed: %v", err)
+	}
+	for _, want := range []string{"1", "2", "1"} {
+		if row, _ := feeder.Next(); row["id"] != want {
+			t.Errorf("Expected id %v, found %v", want, row["id"])
+		}
+	}
+
+	req, _ = http.NewRequest("GET", server.URL+"/{{data.nope}}", nil)
+	w = &Work{Request: req, N: 1, C: 1, Feeder: feeder}
+	if _, err := w.RunContext(context.Background()); err == nil {
+		t.Errorf("Expected an error for an unknown data field")
+	}
+}
+
+func TestHAR(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, r.Method+" "+r.URL.Path+"|"+r.Header.Get("X-Session")+"|"+string(body))
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.har")
+	har := `{"log": {"entries": [
+		{"startedDateTime": "2024-01-01T10:00:00.000Z", "request": {"method": "GET", "url": "` + server.URL + `/page",
+			"headers": [{"name": ":authority", "value": "x"}, {"name": "Host", "value": "x"}, {"name": "x-session", "value": "abc"}]}},
+		{"startedDateTime": "2024-01-01T10:00:00.050Z", "request": {"method": "GET", "url": "data:image/png;base64,AAAA", "headers": []}},
+		{"startedDateTime": "2024-01-01T10:00:00.200Z", "request": {"method": "POST", "url": "` + server.URL + `/api",
+			"headers": [], "postData": {"mimeType": "application/json", "text": "{}"}}}
+	]}}`
+	if err := ioutil.WriteFile(path, []byte(har), 0644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := LoadHAR(path)
+	if err != nil {
+		t.Fatalf("LoadHAR failed: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, found %d", len(targets))
+	}
+	if targets[0].Header.Get("Host") != "" || targets[0].Header.Get("X-Session") != "abc" {
+		t.Errorf("Unexpected headers %v", targets[0].Header)
+	}
+	if targets[1].Label != "#3 POST "+server.URL+"/api" || targets[1].Offset != 200*time.Millisecond {
+		t.Errorf("Unexpected target %q at %v", targets[1].Label, targets[1].Offset)
+	}
+	if ct := targets[1].Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the content type of the post data, found %q", ct)
+	}
+
+	w := &Work{
+		Targets:     targets,
+		TargetOrder: "session",
+		KeepTiming:  true,
+		N:           4,
+		C:           2,
+	}
+	start := time.Now()
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected the recorded timing to be kept, the run took %v", d)
+	}
+	if len(rep.Labels) != 2 || rep.Labels[0].NumRes != 2 || rep.Labels[1].NumRes != 2 {
+		t.Errorf("Expected 2 results for each entry, found %+v", rep.Labels)
+	}
+	want := map[string]int{"GET /page|abc|": 2, "POST /api||{}": 2}
+	for _, g := range got {
+		want[g]--
+	}
+	for k, v := range want {
+		if v != 0 {
+			t.Errorf("Expected 2 requests %q, found %v", k, got)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	log := `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /a?x=1 HTTP/1.0" 200 2326
+127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "-" 408 0
+{"time": "2000-10-10T20:55:38Z", "method": "POST", "path": "/c"}
+127.0.0.1 - frank [10/Oct/2000:13:55:37 -0700] "GET /b HTTP/1.1" 200 10 "-" "Mozilla/5.0"
+`
+	if err := ioutil.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := LoadAccessLog(path, server.URL+"/")
+	if err != nil {
+		t.Fatalf("LoadAccessLog failed: %v", err)
+	}
+	want := []string{"GET /a?x=1", "GET /b", "POST /c"}
+	if len(targets) != len(want) {
+		t.Fatalf("Expected %d targets, found %d", len(want), len(targets))
+	}
+	for i, tg := range targets {
+		if tg.method()+" "+strings.TrimPrefix(tg.URL, server.URL) != want[i] || tg.Offset != time.Duration(i)*time.Second {
+			t.Errorf("Expected %q at %vs, found %q at %v", want[i], i, tg.method()+" "+tg.URL, tg.Offset)
+		}
+	}
+
+	w := &Work{
+		Targets:     targets,
+		Replay:      true,
+		ReplaySpeed: 10,
+		C:           2,
+	}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if rep.NumRes != 3 || len(rep.Labels) != 0 {
+		t.Errorf("Expected 3 unlabeled results, found %d in %d labels", rep.NumRes, len(rep.Labels))
+	}
+	if len(got) != 3 || got[0] != want[0] || got[2] != want[2] {
+		t.Errorf("Expected requests %q, found %q", want, got)
+	}
+	p := rep.Pacing
+	if p == nil || p.Speed != 10 || p.Scheduled != 200*time.Millisecond || p.Actual < p.Scheduled {
+		t.Errorf("Unexpected pacing %+v", p)
+	}
+}
+
+func TestScenario(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.Path+"|"+r.Header.Get("Authorization"))
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s1"})
+			fmt.Fprint(w, `{"token": "abc"}`)
+		case "/items":
+			w.Header().Set("X-Page", "2")
+			fmt.Fprint(w, `{"items": [{"id": 7}]}`)
+		default:
+			fmt.Fprint(w, "name=seven;")
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scenario.json")
+	scenario := `{"name": "browse", "steps": [
+		{"name": "login", "method": "POST", "url": "` + server.URL + `/login", "extract": {"token": "json:token", "sid": "cookie:sid"}, "think_time": "10ms"},
+		{"name": "list", "url": "` + server.URL + `/items?sid={{var.sid}}", "headers": {"Authorization": "Bearer {{var.token}}"}, "extract": {"id": "json:items.0.id", "page": "header:X-Page"}},
+		{"name": "item", "url": "` + server.URL + `/items/{{var.id}}", "headers": {"Authorization": "{{var.page}}"}, "extract": {"name": "regex:name=(\\w+)"}}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(scenario), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadScenario(path)
+	if err != nil {
+		t.Fatalf("LoadScenario failed: %v", err)
+	}
+
+	var results bytes.Buffer
+	w := &Work{Scenario: s, N: 2, C: 1, ResultLog: &results}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if n := strings.Count(results.String(), `"scenario":true`); n != 2 || strings.Count(results.String(), "\n") != 8 {
+		t.Errorf("Expected 6 request and 2 scenario lines in the result log, found %d scenario lines in %q", n, results.String())
+	}
+	want := []string{"/login|", "/items|Bearer abc", "/items/7|2"}
+	if len(got) != 6 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("Expected requests %q twice, found %q", want, got)
+	}
+	if rep.NumRes != 6 || len(rep.Labels) != 3 {
+		t.Errorf("Expected 6 results for 3 steps, found %d for %d", rep.NumRes, len(rep.Labels))
+	}
+	if sc := rep.Scenario; sc == nil || sc.Name != "Scenario browse" || sc.NumRes != 2 || len(sc.FailureDist) != 0 {
+		t.Errorf("Unexpected scenario report %+v", sc)
+	}
+
+	// A step that cannot extract its values stops the run.
+	s.Steps[0].Extract = append(s.Steps[0].Extract, Extractor{Var: "missing", From: "json", Expr: "nope"})
+	got = nil
+	w = &Work{Scenario: s, N: 1, C: 1}
+	if rep, err = w.RunContext(context.Background()); err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if len(got) != 1 || rep.Scenario.FailureDist["login: cannot extract missing: no json nope"] != 1 {
+		t.Errorf("Expected the run to fail at login, found %q and %v", got, rep.Scenario.FailureDist)
+	}
+
+	// Steps may only use the variables of the steps before them.
+	s.Steps[0].URL = server.URL + "/login/{{var.id}}"
+	w = &Work{Scenario: s, N: 1, C: 1}
+	if _, err := w.RunContext(context.Background()); err == nil {
+		t.Errorf("Expected a step using a later variable to fail")
+	}
+	// Run reports it too, rather than sending requests.
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	got = nil
+	w = &Work{Scenario: s, N: 1, C: 1, Writer: ioutil.Discard}
+	w.Run()
+	if len(got) != 0 || !strings.Contains(logs.String(), "var.id") || w.Passed() {
+		t.Errorf("Expected Run to log the error and send nothing, found %q and log %q", got, logs.String())
+	}
+}
+
+func TestCookieJars(t *testing.T) {
+	var mu sync.Mutex
+	sessions := make(map[string]int)
+	var conns int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("session")
+		if err != nil {
+			// Set the session with a redirect, as login pages do.
+			n := atomic.AddInt64(&conns, 1)
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: strconv.FormatInt(n, 10), Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		mu.Lock()
+		sessions[c.Value]++
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Request: req, N: 20, C: 4, CookieJars: true, WorkerConnections: true}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if rep.NumRes != 20 || len(sessions) != 4 {
+		t.Errorf("Expected 20 requests in 4 sessions, found %d in %v", rep.NumRes, sessions)
+	}
+	for s, n := range sessions {
+		if n != 5 {
+			t.Errorf("Expected 5 requests in session %s, found %d", s, n)
+		}
+	}
+
+	sessions = make(map[string]int)
+	w = &Work{Request: req, N: 4, C: 2}
+	if _, err := w.RunContext(context.Background()); err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("Expected no cookies to be kept without cookie jars, found %v", sessions)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	var mu sync.Mutex
+	addrs := make(map[string]int)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		addrs[r.RemoteAddr]++
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Request: req, N: 40, C: 8, Connections: 2}
+	rep, err := w.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Errorf("Expected requests over 2 connections, found %v", addrs)
+	}
+	if c := rep.Connections; c.Opened != 2 || c.Reused != 38 || c.Closed != 0 {
+		t.Errorf("Expected 2 connections opened and 38 requests reusing them, found %+v", c)
+	}
+
+	addrs = make(map[string]int)
+	w = &Work{Request: req, N: 20, C: 4, DisableKeepAlives: true}
+	if rep, err = w.RunContext(context.Background()); err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if c := rep.Connections; c.Opened != 20 || c.Reused != 0 {
+		t.Errorf("Expected 20 connections opened and none reused, found %+v", c)
+	}
+
+	addrs = make(map[string]int)
+	w = &Work{Request: req, N: 20, C: 4, WorkerConnections: true}
+	if _, err = w.RunContext(context.Background()); err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if len(addrs) != 4 {
+		t.Errorf("Expected requests over 4 connections, found %v", addrs)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The certificate of the server is its own CA, and the client's too.
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	key, err := x509.MarshalPKCS8PrivateKey(server.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts  TLSOptions
+		error string
+	}{
+		{TLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2"}, ""},
+		{TLSOptions{CertFile: certFile, KeyFile: keyFile, MaxVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, ""},
+		{TLSOptions{CAFile: certFile}, "TLS handshake: remote error: "},
+		{TLSOptions{Verify: true, CertFile: certFile, KeyFile: keyFile}, "TLS handshake: x509: "},
+	}
+	for _, tt := range tests {
+		config, err := tt.opts.Config()
+		if err != nil {
+			t.Fatalf("Config(%+v) failed: %v", tt.opts, err)
+		}
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		w := &Work{Request: req, N: 4, C: 2, TLSConfig: config}
+		rep, err := w.RunContext(context.Background())
+		if err != nil {
+			t.Fatalf("RunContext failed: %v", err)
+		}
+		if tt.error == "" {
+			if rep.StatusCodeDist[200] != 4 {
+				t.Errorf("%+v: expected 4 responses, found %v and errors %v", tt.opts, rep.StatusCodeDist, rep.ErrorDist)
+			}
+			continue
+		}
+		if len(rep.ErrorDist) != 1 {
+			t.Errorf("%+v: expected a single error, found %v", tt.opts, rep.ErrorDist)
+		}
+		for e, n := range rep.ErrorDist {
+			if !strings.HasPrefix(e, tt.error) || n != 4 {
+				t.Errorf("%+v: expected 4 errors %q..., found %d %q", tt.opts, tt.error, n, e)
+			}
+		}
+	}
+
+	for _, opts := range []TLSOptions{
+		{CertFile: certFile},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{MinVersion: "2"},
+		{CipherSuites: []string{"TLS_NULL"}},
+		{CAFile: keyFile},
+	} {
+		if _, err := opts.Config(); err == nil {
+			t.Errorf("Config(%+v) did not fail", opts)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Scenario is a flow of requests a virtual user goes through, such as
+// logging in, listing items and then fetching one of them, with values
+// taken from the responses of its steps used by the later ones.
+type Scenario struct {
+	// Name names the scenario in the report.
+	Name string
+
+	Steps []*Step
+}
+
+// Step is a request of a scenario. Its URL path and query, header values
+// and body are templates, as with Work.Templated, which may also refer to
+// the variables extracted by the earlier steps as {{var.name}}.
+type Step struct {
+	// Name names the step in the report. Defaults to the method followed
+	// by the URL.
+	Name string
+
+	// Method is the HTTP method. Defaults to GET.
+	Method string
+
+	URL    string
+	Header http.Header
+	Body   []byte
+
+	// Extract lists the values to take from the response.
+	Extract []Extractor
+
+	// ThinkTime is how long the user waits after the step, before the
+	// next one.
+	ThinkTime time.Duration
+}
+
+// Extractor takes a value from the response of a step into a variable.
+type Extractor struct {
+	// Var is the name of the variable.
+	Var string
+
+	// From is where the value is: "json" takes the field at the path
+	// Expr of a JSON body, such as data.items.0.id; "regex" the first
+	// group, or else the match, of the regexp Expr in the body; "header"
+	// the value of the header Expr; and "cookie" the value of the cookie
+	// Expr set by the response.
+	From string
+	Expr string
+}
+
+// ParseExtractor parses an extractor written as var=from:expr, such as
+// token=json:data.token or id=regex:"id":(\d+).
+func ParseExtractor(s string) (Extractor, error) {
+	i := strings.Index(s, "=")
+	j := strings.Index(s, ":")
+	if i <= 0 || j < i {
+		return Extractor{}, fmt.Errorf("requester: extractor %q is not var=from:expr", s)
+	}
+	e := Extractor{Var: s[:i], From: s[i+1 : j], Expr: s[j+1:]}
+	if _, err := e.compile(); err != nil {
+		return Extractor{}, err
+	}
+	return e, nil
+}
+
+// compile returns the regexp of a regex extractor, or nil for the others,
+// after checking the extractor.
+func (e Extractor) compile() (*regexp.Regexp, error) {
+	if e.Var == "" || e.Expr == "" {
+		return nil, fmt.Errorf("requester: extractor %s=%s:%s has no variable or expression", e.Var, e.From, e.Expr)
+	}
+	switch e.From {
+	case "json", "header", "cookie":
+		return nil, nil
+	case "regex":
+		return regexp.Compile(e.Expr)
+	}
+	return nil, fmt.Errorf("requester: unknown extractor source %q, not json, regex, header or cookie", e.From)
+}
+
+// preparedStep is a step with its request built once.
+type preparedStep struct {
+	preparedTarget
+	extract  []Extractor
+	res      []*regexp.Regexp // of each extractor, if it is a regex
+	readBody bool             // whether the extractors need the body
+	think    time.Duration
+}
+
+// prepareScenario builds the requests of the steps of s, and checks that
+// they only refer to data fields of f and to variables extracted earlier.
+func prepareScenario(s *Scenario, f *Feeder) ([]preparedStep, error) {
+	if len(s.Steps) == 0 {
+		return nil, errors.New("requester: scenario has no steps")
+	}
+	sc := tmplScope{feeder: f, vars: make(map[string]bool)}
+	var steps []preparedStep
+	for _, st := range s.Steps {
+		t := &Target{Method: st.Method, URL: st.URL, Header: st.Header, Body: st.Body, Label: st.Name}
+		ps := preparedStep{preparedTarget: prepareTarget(t, true, sc), extract: st.Extract, think: st.ThinkTime}
+		if ps.err != nil {
+			return nil, ps.err
+		}
+		// The variables of a step are only known to the steps after it.
+		vars := make(map[string]bool)
+		for k := range sc.vars {
+			vars[k] = true
+		}
+		for _, e := range st.Extract {
+			re, err := e.compile()
+			if err != nil {
+				return nil, fmt.Errorf("requester: step %s: %v", t.label(), err)
+			}
+			ps.res = append(ps.res, re)
+			ps.readBody = ps.readBody || e.From == "json" || e.From == "regex"
+			vars[e.Var] = true
+		}
+		sc.vars = vars
+		steps = append(steps, ps)
+	}
+	return steps, nil
+}
+
+// read reads the response of the step, checks it against e, if not nil,
+// and extracts its values into vars. It returns why the response is a
+// failure, if it is, and the size of its body.
+func (st *preparedStep) read(resp *http.Response, e *Expect, vars map[string]string) (string, int64, error) {
+	var body []byte
+	var size int64
+	var err error
+	if st.readBody || (e != nil && e.needsBody()) {
+		body, err = ioutil.ReadAll(resp.Body)
+		size = int64(len(body))
+	} else {
+		size, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	if err != nil {
+		return "", size, err
+	}
+	if e != nil {
+		if failure := e.match(resp, body, size); failure != "" {
+			return failure, size, nil
+		}
+	}
+
+	var doc interface{}
+	var parsed bool
+	for i, ex := range st.extract {
+		var v string
+		var ok bool
+		switch ex.From {
+		case "json":
+			if !parsed {
+				if err := json.Unmarshal(body, &doc); err != nil {
+					return fmt.Sprintf("cannot extract %s: body is not JSON", ex.Var), size, nil
+				}
+				parsed = true
+			}
+			var jv interface{}
+			if jv, ok = lookupJSON(doc, ex.Expr); ok {
+				v = jsonString(jv)
+			}
+		case "regex":
+			if m := st.res[i].FindSubmatch(body); m != nil {
+				v, ok = string(m[len(m)-1]), true
+				if len(m) > 1 {
+					v = string(m[1])
+				}
+			}
+		case "header":
+			var vs []string
+			if vs, ok = resp.Header[http.CanonicalHeaderKey(ex.Expr)]; ok {
+				v = vs[0]
+			}
+		case "cookie":
+			for _, c := range resp.Cookies() {
+				if c.Name == ex.Expr {
+					v, ok = c.Value, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return fmt.Sprintf("cannot extract %s: no %s %s", ex.Var, ex.From, ex.Expr), size, nil
+		}
+		vars[ex.Var] = v
+	}
+	return "", size, nil
+}
+
+// runScenario runs the scenario once, as the given worker, s being the
+// time the run is considered to have started. Each step is reported under
+// its name, and the whole run, without the think times, in the scenario
+// group. A run stops at the first step that fails. It returns false if
+// there are no more runs to make.
+func (b *Work) runScenario(c *http.Client, s time.Duration, worker int) bool {
+	n := atomic.AddInt64(&b.sent, 1)
+	warmUp := s-b.start < b.WarmUp || n <= int64(b.WarmUpRequests)
+	var row map[string]string
+	if b.Feeder != nil {
+		var ok bool
+		if row, ok = b.Feeder.Next(); !ok {
+			return false
+		}
+	}
+	v := b.vars(n, worker, row)
+	v.vars = make(map[string]string)
+
+	run := &result{offset: s - b.start, scenario: true, warmUp: warmUp, label: b.scenarioName()}
+	var think time.Duration
+	for i := range b.steps {
+		st := &b.steps[i]
+		if i > 0 && b.steps[i-1].think > 0 {
+			t := time.NewTimer(b.steps[i-1].think)
+			select {
+			case <-t.C:
+			case <-b.ctx.Done():
+				t.Stop()
+				run.cancelled = true
+				b.results <- run
+				return true
+			}
+			think += b.steps[i-1].think
+		}
+		req := cloneRequest(st.req, st.body)
+		if st.tmpl != nil {
+			req = st.tmpl.execute(v)
+		}
+		res := b.send(c, req, now(), func(resp *http.Response) (string, int64, error) {
+			return st.read(resp, b.Expect, v.vars)
+		})
+		res.label = st.label
+		res.warmUp = warmUp
+		b.results <- res
+		switch {
+		case res.cancelled:
+			run.cancelled = true
+		case res.err != nil:
+			run.err = fmt.Errorf("%s: %v", st.label, res.err)
+		case res.failure != "":
+			run.failure = st.label + ": " + res.failure
+		}
+		run.statusCode = res.statusCode
+		run.contentLength += res.contentLength
+		if run.cancelled || run.err != nil || run.failure != "" {
+			break
+		}
+	}
+	run.duration = now() - s - think
+	b.results <- run
+	return true
+}
+
+func (b *Work) scenarioName() string {
+	if b.Scenario.Name == "" {
+		return "Scenario"
+	}
+	return "Scenario " + b.Scenario.Name
+}
+
+// scenarioJSON is a scenario file.
+type scenarioJSON struct {
+	Name  string `json:"name"`
+	Steps []struct {
+		Name      string            `json:"name"`
+		Method    string            `json:"method"`
+		URL       string            `json:"url"`
+		Headers   map[string]string `json:"headers"`
+		Body      string            `json:"body"`
+		BodyFile  string            `json:"body_file"`
+		Extract   map[string]string `json:"extract"`
+		ThinkTime string            `json:"think_time"`
+	} `json:"steps"`
+}
+
+// LoadScenario reads a scenario from a JSON file, such as:
+//
+//	{"name": "browse", "steps": [
+//	  {"name": "login", "method": "POST", "url": "http://localhost/login", "body": "{\"user\": \"{{data.user}}\"}", "extract": {"token": "json:token"}, "think_time": "1s"},
+//	  {"name": "list", "url": "http://localhost/items", "headers": {"Authorization": "Bearer {{var.token}}"}, "extract": {"id": "json:items.0.id"}},
+//	  {"name": "item", "url": "http://localhost/items/{{var.id}}", "headers": {"Authorization": "Bearer {{var.token}}"}}
+//	]}
+//
+// "extract" maps variables to where their value is, as from:expr; see
+// Extractor. "body_file" is the path to a file holding the body, relative
+// to the scenario file, and "think_time" a duration such as 500ms.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sj scenarioJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	s := &Scenario{Name: sj.Name}
+	for i, stj := range sj.Steps {
+		if stj.URL == "" {
+			return nil, fmt.Errorf("%s: step %d: missing url", path, i+1)
+		}
+		st := &Step{
+			Name:   stj.Name,
+			Method: stj.Method,
+			URL:    stj.URL,
+			Header: make(http.Header),
+		}
+		for k, v := range stj.Headers {
+			st.Header.Set(k, v)
+		}
+		if stj.Body != "" {
+			st.Body = []byte(stj.Body)
+		}
+		if stj.BodyFile != "" {
+			name := stj.BodyFile
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(path), name)
+			}
+			if st.Body, err = ioutil.ReadFile(name); err != nil {
+				return nil, fmt.Errorf("%s: step %d: %v", path, i+1, err)
+			}
+		}
+		names := make([]string, 0, len(stj.Extract))
+		for name := range stj.Extract {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			e, err := ParseExtractor(name + "=" + stj.Extract[name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: step %d: %v", path, i+1, err)
+			}
+			st.Extract = append(st.Extract, e)
+		}
+		if stj.ThinkTime != "" {
+			if st.ThinkTime, err = time.ParseDuration(stj.ThinkTime); err != nil {
+				return nil, fmt.Errorf("%s: step %d: %v", path, i+1, err)
+			}
+		}
+		s.Steps = append(s.Steps, st)
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	return s, nil
+}
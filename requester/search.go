@@ -0,0 +1,188 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Search looks for the highest load level at which the 99th percentile
+// latency and the error rate stay within the given limits. Each level is
+// measured with a short run of its own.
+type Search struct {
+	// NewWork returns the work to measure a level with. It is called
+	// once per level, and the search then sets the level and the length
+	// of the run on the returned Work.
+	NewWork func() *Work
+
+	// Rate searches the arrival rate (Work.Rate) instead of the number
+	// of workers (Work.C).
+	Rate bool
+
+	// Start, Step and Max describe the levels to try. Levels are tried
+	// from Start upwards in increments of Step, up to Max. Step must be
+	// positive.
+	Start float64
+	Step  float64
+	Max   float64
+
+	// Bisect tries Start and Max first and then halves the range between
+	// the highest passing and the lowest failing level until it is no
+	// wider than Step, instead of stepping through every level.
+	Bisect bool
+
+	// Window is how long each level is measured for.
+	Window time.Duration
+
+	// P99 is the highest acceptable 99th percentile latency.
+	P99 time.Duration
+
+	// MaxErrorRate is the highest acceptable fraction of requests that
+	// fail, either with an error, with a 5xx status code, or by not
+	// matching Work.Expect.
+	MaxErrorRate float64
+
+	// Writer is where the results will be written. If nil, results are
+	// written to stdout.
+	Writer io.Writer
+}
+
+// SearchLevel is the outcome of measuring a single load level.
+type SearchLevel struct {
+	Level     float64
+	Rps       float64
+	P99       float64 // in seconds
+	ErrorRate float64
+	Pass      bool
+}
+
+// SearchResult holds every level a search tried, in the order they were
+// tried, and the highest level that passed.
+type SearchResult struct {
+	Levels []SearchLevel
+	Best   *SearchLevel
+}
+
+// Run runs the search, prints a table of the levels tried, and returns
+// the results.
+func (s *Search) Run() *SearchResult {
+	res := &SearchResult{}
+	try := func(level float64) bool {
+		l := s.measure(level)
+		res.Levels = append(res.Levels, l)
+		if l.Pass && (res.Best == nil || l.Level > res.Best.Level) {
+			best := l
+			res.Best = &best
+		}
+		return l.Pass
+	}
+
+	if s.Bisect {
+		lo, hi := s.Start, s.Max
+		if try(lo) && !try(hi) {
+			for hi-lo > s.Step {
+				mid := s.round(lo + (hi-lo)/2)
+				if mid <= lo || mid >= hi {
+					break
+				}
+				if try(mid) {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+		}
+	} else {
+		for i := 0; ; i++ {
+			level := s.Start + float64(i)*s.Step
+			if level > s.Max || !try(level) {
+				break
+			}
+		}
+	}
+	s.print(res)
+	return res
+}
+
+// round rounds worker counts to whole numbers.
+func (s *Search) round(level float64) float64 {
+	if s.Rate {
+		return level
+	}
+	return math.Floor(level)
+}
+
+func (s *Search) measure(level float64) SearchLevel {
+	w := s.NewWork()
+	w.Stages = nil
+	ctx := context.Background()
+	if s.Rate {
+		w.Rate = level
+		w.N = int(math.Ceil(level * s.Window.Seconds()))
+	} else {
+		w.Rate = 0
+		w.C = int(level)
+		w.N = math.MaxInt32
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Window)
+		defer cancel()
+	}
+	rep, _ := w.RunContext(ctx)
+	if rep == nil {
+		return SearchLevel{Level: level}
+	}
+
+	l := SearchLevel{Level: level, Rps: rep.Rps}
+	for _, d := range rep.LatencyDistribution {
+		if d.Percentile == 99 {
+			l.P99 = d.Latency
+		}
+	}
+	if rep.NumRes > 0 {
+		l.ErrorRate = rep.errorRate()
+	}
+	l.Pass = rep.NumRes > 0 && l.P99 <= s.P99.Seconds() && l.ErrorRate <= s.MaxErrorRate
+	return l
+}
+
+func (s *Search) print(res *SearchResult) {
+	w := s.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	unit := "workers"
+	if s.Rate {
+		unit = "req/s"
+	}
+	fmt.Fprintf(w, "\nSearch (p99 <= %4.4f secs, error rate <= %.2f%%):\n", s.P99.Seconds(), s.MaxErrorRate*100)
+	fmt.Fprintf(w, "  Level\tRequests/sec\tp99\tErrors\tResult\n")
+	for _, l := range res.Levels {
+		result := "fail"
+		if l.Pass {
+			result = "pass"
+		}
+		fmt.Fprintf(w, "  %v %s\t%4.4f\t%4.4f secs\t%.2f%%\t%s\n", l.Level, unit, l.Rps, l.P99, l.ErrorRate*100, result)
+	}
+	if res.Best == nil {
+		fmt.Fprintf(w, "\nNo level met the limits.\n\n")
+		return
+	}
+	fmt.Fprintf(w, "\nHighest sustainable level: %v %s (%4.4f requests/sec)\n\n", res.Best.Level, unit, res.Best.Rps)
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// How often idle workers check whether a concurrency ramp needs them.
+const stageTick = 10 * time.Millisecond
+
+// Stage is one step of a load profile. Over Duration, the load changes
+// linearly from the target of the previous stage (zero for the first
+// stage) to the target of this one. A stage with the same target as the
+// previous one holds the load steady, and a stage with a zero Duration
+// jumps straight to its target.
+//
+// The target is either a number of concurrent workers, C, or an arrival
+// rate in requests per second, Rate. All stages of a profile must use the
+// same kind of target.
+type Stage struct {
+	Duration time.Duration
+	C        int
+	Rate     float64
+}
+
+// profile is the sequence of stages a run goes through.
+type profile []Stage
+
+// isRate reports whether the profile is driven by arrival rate rather
+// than by concurrency.
+func (p profile) isRate() bool {
+	for _, s := range p {
+		if s.Rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p profile) target(i int) float64 {
+	if i < 0 {
+		return 0
+	}
+	if p.isRate() {
+		return p[i].Rate
+	}
+	return float64(p[i].C)
+}
+
+func (p profile) duration() time.Duration {
+	var d time.Duration
+	for _, s := range p {
+		d += s.Duration
+	}
+	return d
+}
+
+// maxC returns the highest concurrency target of the profile.
+func (p profile) maxC() int {
+	var c int
+	for _, s := range p {
+		if s.C > c {
+			c = s.C
+		}
+	}
+	return c
+}
+
+// level returns the target load at time t since the start of the run.
+func (p profile) level(t time.Duration) float64 {
+	var start time.Duration
+	for i, s := range p {
+		end := start + s.Duration
+		if t < end {
+			from, to := p.target(i-1), p.target(i)
+			return from + (to-from)*float64(t-start)/float64(s.Duration)
+		}
+		start = end
+	}
+	return p.target(len(p) - 1)
+}
+
+// arrival returns the time since the start of the run at which the nth
+// request of a rate profile is due, that is, the time at which the rate
+// integrated from zero reaches n. It reports false if the profile ends
+// before that.
+func (p profile) arrival(n int) (time.Duration, bool) {
+	x := float64(n)
+	var start time.Duration
+	for i, s := range p {
+		from, to := p.target(i-1), p.target(i)
+		d := s.Duration.Seconds()
+		count := (from + to) / 2 * d
+		if x < count {
+			// Solve from*t + (to-from)/(2d)*t^2 = x for t.
+			var t float64
+			if a := (to - from) / (2 * d); a == 0 {
+				t = x / from
+			} else {
+				t = (-from + math.Sqrt(from*from+4*a*x)) / (2 * a)
+			}
+			return start + time.Duration(t*float64(time.Second)), true
+		}
+		x -= count
+		start += s.Duration
+	}
+	return 0, false
+}
+
+// name returns a short description of the ith stage.
+func (p profile) name(i int) string {
+	unit := "workers"
+	if p.isRate() {
+		unit = "req/s"
+	}
+	from, to := p.target(i-1), p.target(i)
+	switch {
+	case p[i].Duration == 0:
+		return fmt.Sprintf("Stage %d (jump to %v %s)", i+1, to, unit)
+	case from == to:
+		return fmt.Sprintf("Stage %d (hold %v %s for %v)", i+1, to, unit, p[i].Duration)
+	}
+	return fmt.Sprintf("Stage %d (ramp from %v to %v %s over %v)", i+1, from, to, unit, p[i].Duration)
+}
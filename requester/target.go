@@ -0,0 +1,249 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Target describes one of the requests to send when a run covers
+// several endpoints.
+type Target struct {
+	// Method is the HTTP method. Defaults to GET.
+	Method string
+
+	URL    string
+	Header http.Header
+	Body   []byte
+
+	// Label names the target in the report. Defaults to the method
+	// followed by the URL.
+	Label string
+
+	// Weight is how often the target is picked relative to the other
+	// targets when they are picked by weight. Defaults to 1.
+	Weight int
+
+	// Offset is when the target was sent in a recorded session, since
+	// the first request of the session. See Work.KeepTiming.
+	Offset time.Duration
+}
+
+func (t *Target) label() string {
+	if t.Label != "" {
+		return t.Label
+	}
+	return t.method() + " " + t.URL
+}
+
+func (t *Target) method() string {
+	if t.Method == "" {
+		return "GET"
+	}
+	return strings.ToUpper(t.Method)
+}
+
+func (t *Target) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// preparedTarget is a target with its request built once, to be cloned
+// for every request sent.
+type preparedTarget struct {
+	req    *http.Request
+	body   []byte
+	tmpl   *requestTemplate // if the target has placeholders
+	label  string
+	offset time.Duration
+	err    error
+}
+
+// targetPicker picks the target of each request.
+type targetPicker struct {
+	targets []preparedTarget
+	order   string
+	next    uint64
+	cum     []int // cumulative weights
+
+	pos       []int           // of the next target of each worker, in the session order
+	passStart []time.Duration // when each worker sent the first target of its pass
+}
+
+// newTargetPicker prepares the targets for the given number of workers,
+// parsing their templates if templated is set, with the data fields of f.
+func newTargetPicker(targets []*Target, order string, workers int, templated bool, f *Feeder) *targetPicker {
+	p := &targetPicker{order: order}
+	if order == "session" {
+		p.pos = make([]int, workers)
+		p.passStart = make([]time.Duration, workers)
+	}
+	var total int
+	for _, t := range targets {
+		p.targets = append(p.targets, prepareTarget(t, templated, tmplScope{feeder: f}))
+		total += t.weight()
+		p.cum = append(p.cum, total)
+	}
+	return p
+}
+
+// prepareTarget builds the request of t, and parses its templates, which
+// may refer to sc, if templated is set.
+func prepareTarget(t *Target, templated bool, sc tmplScope) preparedTarget {
+	req, err := http.NewRequest(t.method(), t.URL, nil)
+	var tmpl *requestTemplate
+	if err == nil {
+		for k, v := range t.Header {
+			req.Header[k] = v
+		}
+		req.ContentLength = int64(len(t.Body))
+		if templated {
+			if tmpl, err = newRequestTemplate(req, t.Body, sc); err != nil {
+				err = fmt.Errorf("requester: target %s: %v", t.label(), err)
+			}
+		}
+	}
+	return preparedTarget{req: req, body: t.Body, tmpl: tmpl, label: t.label(), offset: t.Offset, err: err}
+}
+
+// pick returns the target of the next request of the worker.
+func (p *targetPicker) pick(worker int) *preparedTarget {
+	var i int
+	switch p.order {
+	case "session":
+		i = p.pos[worker] % len(p.targets)
+		p.pos[worker]++
+	case "random":
+		i = rand.Intn(len(p.targets))
+	case "weighted":
+		i = sort.SearchInts(p.cum, rand.Intn(p.cum[len(p.cum)-1])+1)
+	default:
+		i = int((atomic.AddUint64(&p.next, 1) - 1) % uint64(len(p.targets)))
+	}
+	return &p.targets[i]
+}
+
+// wait blocks until the next target of the worker in the session order
+// is due, its offset after the worker started its pass over the targets,
+// and reports whether it is, or false if stop was closed first.
+func (p *targetPicker) wait(worker int, stop <-chan struct{}) bool {
+	i := p.pos[worker] % len(p.targets)
+	if i == 0 {
+		p.passStart[worker] = now()
+		return true
+	}
+	d := p.passStart[worker] + p.targets[i].offset - now()
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// targetJSON is a line of a targets file.
+type targetJSON struct {
+	Method   string            `json:"method"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	BodyFile string            `json:"body_file"`
+	Label    string            `json:"label"`
+	Weight   int               `json:"weight"`
+}
+
+// LoadTargets reads targets from a file with one JSON object per line,
+// such as:
+//
+//	{"method": "POST", "url": "http://localhost/items", "headers": {"Content-Type": "application/json"}, "body_file": "item.json", "label": "create", "weight": 2}
+//
+// Only "url" is required. "body" is the request body itself, and
+// "body_file" the path to a file holding it, relative to the targets file.
+// Empty lines and lines starting with # are ignored.
+func LoadTargets(path string) ([]*Target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []*Target
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var tj targetJSON
+		if err := json.Unmarshal([]byte(text), &tj); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if tj.URL == "" {
+			return nil, fmt.Errorf("%s:%d: missing url", path, line)
+		}
+		t := &Target{
+			Method: tj.Method,
+			URL:    tj.URL,
+			Header: make(http.Header),
+			Label:  tj.Label,
+			Weight: tj.Weight,
+		}
+		if _, err := http.NewRequest(t.method(), t.URL, nil); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		for k, v := range tj.Headers {
+			t.Header.Set(k, v)
+		}
+		if tj.Body != "" {
+			t.Body = []byte(tj.Body)
+		}
+		if tj.BodyFile != "" {
+			name := tj.BodyFile
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(path), name)
+			}
+			if t.Body, err = ioutil.ReadFile(name); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		}
+		targets = append(targets, t)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s: no targets", path)
+	}
+	return targets, nil
+}
@@ -0,0 +1,288 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tmplVars are the values placeholders are replaced with for a request.
+type tmplVars struct {
+	seq    int64 // number of the request in the run, from 1
+	worker int
+	rnd    *rand.Rand        // of the worker, as rand.Rand is not safe for concurrent use
+	row    map[string]string // from Work.Feeder, shared by all the templates of the request
+	vars   map[string]string // extracted by the earlier steps of a scenario
+}
+
+// tmplScope is what the placeholders of a template may refer to.
+type tmplScope struct {
+	feeder *Feeder
+	vars   map[string]bool // the variables extracted by the earlier steps of a scenario
+}
+
+// reqTemplate is text with placeholders, such as "/items/{{seq}}". It is
+// parsed once, so executing it only appends the parts to a buffer.
+type reqTemplate struct {
+	parts []tmplPart
+}
+
+// tmplPart is either literal text or a placeholder, which appends its
+// value to b.
+type tmplPart struct {
+	text string
+	gen  func(b []byte, v *tmplVars) []byte
+}
+
+// parseTemplate parses s, or returns nil if it has no placeholders. The
+// data and var placeholders may refer to the fields and variables of sc,
+// and their values are escaped if s is a URL query.
+func parseTemplate(s string, sc tmplScope, query bool) (*reqTemplate, error) {
+	if !strings.Contains(s, "{{") {
+		return nil, nil
+	}
+	t := &reqTemplate{}
+	for {
+		i := strings.Index(s, "{{")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i:], "}}")
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in %q", s)
+		}
+		if i > 0 {
+			t.parts = append(t.parts, tmplPart{text: s[:i]})
+		}
+		gen, err := newGenerator(strings.Fields(s[i+2:i+j]), sc, query)
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, tmplPart{gen: gen})
+		s = s[i+j+2:]
+	}
+	if s != "" {
+		t.parts = append(t.parts, tmplPart{text: s})
+	}
+	return t, nil
+}
+
+func (t *reqTemplate) execute(b []byte, v *tmplVars) []byte {
+	for _, p := range t.parts {
+		if p.gen != nil {
+			b = p.gen(b, v)
+		} else {
+			b = append(b, p.text...)
+		}
+	}
+	return b
+}
+
+func (t *reqTemplate) string(v *tmplVars) string {
+	return string(t.execute(make([]byte, 0, 64), v))
+}
+
+const alphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// newGenerator returns the function appending the value of a placeholder,
+// given its name and arguments.
+func newGenerator(args []string, sc tmplScope, query bool) (func(b []byte, v *tmplVars) []byte, error) {
+	if len(args) == 0 {
+		return nil, errors.New("empty placeholder {{}}")
+	}
+	name, args := args[0], args[1:]
+	if strings.HasPrefix(name, "data.") && len(args) == 0 {
+		field := strings.TrimPrefix(name, "data.")
+		if sc.feeder == nil || !sc.feeder.hasField(field) {
+			return nil, fmt.Errorf("no data field %q for {{%s}}", field, name)
+		}
+		return appendValue(func(v *tmplVars) string { return v.row[field] }, query), nil
+	}
+	if strings.HasPrefix(name, "var.") && len(args) == 0 {
+		key := strings.TrimPrefix(name, "var.")
+		if !sc.vars[key] {
+			return nil, fmt.Errorf("no variable %q extracted by an earlier step for {{%s}}", key, name)
+		}
+		return appendValue(func(v *tmplVars) string { return v.vars[key] }, query), nil
+	}
+	ints := make([]int64, len(args))
+	for i, a := range args {
+		n, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %q of {{%s}}", a, name)
+		}
+		ints[i] = n
+	}
+	arity := map[string]int{"randInt": 2, "randString": 1}[name]
+	if len(args) != arity {
+		return nil, fmt.Errorf("{{%s}} takes %d arguments", name, arity)
+	}
+
+	switch name {
+	case "seq":
+		return func(b []byte, v *tmplVars) []byte {
+			return strconv.AppendInt(b, v.seq, 10)
+		}, nil
+	case "worker":
+		return func(b []byte, v *tmplVars) []byte {
+			return strconv.AppendInt(b, int64(v.worker), 10)
+		}, nil
+	case "uuid":
+		return appendUUID, nil
+	case "randInt":
+		min, max := ints[0], ints[1]
+		if max < min {
+			return nil, fmt.Errorf("{{randInt %d %d}} has an empty range", min, max)
+		}
+		return func(b []byte, v *tmplVars) []byte {
+			return strconv.AppendInt(b, min+v.rnd.Int63n(max-min+1), 10)
+		}, nil
+	case "randString":
+		n := int(ints[0])
+		if n <= 0 {
+			return nil, fmt.Errorf("{{randString %d}} has no length", n)
+		}
+		return func(b []byte, v *tmplVars) []byte {
+			for i := 0; i < n; i++ {
+				b = append(b, alphanumeric[v.rnd.Intn(len(alphanumeric))])
+			}
+			return b
+		}, nil
+	case "timestamp":
+		return func(b []byte, v *tmplVars) []byte {
+			return strconv.AppendInt(b, time.Now().Unix(), 10)
+		}, nil
+	case "timestampMs":
+		return func(b []byte, v *tmplVars) []byte {
+			return strconv.AppendInt(b, time.Now().UnixNano()/int64(time.Millisecond), 10)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown placeholder {{%s}}", name)
+}
+
+// appendValue returns a generator appending the value given by get,
+// escaped if it is in a URL query.
+func appendValue(get func(v *tmplVars) string, query bool) func(b []byte, v *tmplVars) []byte {
+	if query {
+		return func(b []byte, v *tmplVars) []byte {
+			return append(b, url.QueryEscape(get(v))...)
+		}
+	}
+	return func(b []byte, v *tmplVars) []byte {
+		return append(b, get(v)...)
+	}
+}
+
+// appendUUID appends a random, version 4 UUID.
+func appendUUID(b []byte, v *tmplVars) []byte {
+	var u [16]byte
+	v.rnd.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	const hex = "0123456789abcdef"
+	for i, c := range u {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			b = append(b, '-')
+		}
+		b = append(b, hex[c>>4], hex[c&0x0f])
+	}
+	return b
+}
+
+// requestTemplate builds requests from a request whose URL path and
+// query, header values and body may have placeholders.
+type requestTemplate struct {
+	req    *http.Request
+	body   []byte
+	path   *reqTemplate
+	query  *reqTemplate
+	header map[string][]*reqTemplate // the templates of the header values with placeholders
+	tbody  *reqTemplate
+}
+
+// newRequestTemplate parses the templates of req, or returns nil if it
+// has no placeholders.
+func newRequestTemplate(req *http.Request, body []byte, sc tmplScope) (*requestTemplate, error) {
+	t := &requestTemplate{req: req, body: body}
+	var err error
+	if t.path, err = parseTemplate(req.URL.Path, sc, false); err != nil {
+		return nil, err
+	}
+	if t.query, err = parseTemplate(req.URL.RawQuery, sc, true); err != nil {
+		return nil, err
+	}
+	if t.tbody, err = parseTemplate(string(body), sc, false); err != nil {
+		return nil, err
+	}
+	for k, vs := range req.Header {
+		for i, s := range vs {
+			vt, err := parseTemplate(s, sc, false)
+			if err != nil {
+				return nil, err
+			}
+			if vt == nil {
+				continue
+			}
+			if t.header == nil {
+				t.header = make(map[string][]*reqTemplate)
+			}
+			if t.header[k] == nil {
+				t.header[k] = make([]*reqTemplate, len(vs))
+			}
+			t.header[k][i] = vt
+		}
+	}
+	if t.path == nil && t.query == nil && t.tbody == nil && t.header == nil {
+		return nil, nil
+	}
+	return t, nil
+}
+
+func (t *requestTemplate) execute(v *tmplVars) *http.Request {
+	r := cloneRequest(t.req, t.body)
+	if t.path != nil || t.query != nil {
+		u := *t.req.URL
+		if t.path != nil {
+			u.Path = t.path.string(v)
+			u.RawPath = ""
+		}
+		if t.query != nil {
+			u.RawQuery = t.query.string(v)
+		}
+		r.URL = &u
+	}
+	for k, vts := range t.header {
+		for i, vt := range vts {
+			if vt != nil {
+				r.Header[k][i] = vt.string(v)
+			}
+		}
+	}
+	if t.tbody != nil {
+		body := t.tbody.execute(make([]byte, 0, len(t.body)), v)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return r
+}
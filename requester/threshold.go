@@ -0,0 +1,195 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threshold is a condition the results of a run must meet, such as
+// "p95 < 200ms". A run passes if it meets all of its thresholds.
+//
+// The metrics are:
+//   - p50, p95, p99.9 and the other reported percentiles: latency in seconds.
+//   - avg, fastest and slowest: latency in seconds.
+//   - rps: requests per second.
+//   - error_rate: the fraction of requests that failed with an error, did not
+//     match Work.Expect or had a 5xx status code.
+//   - 2xx, 3xx, 4xx and 5xx: the number of responses with a status code of the class.
+//
+// A metric with no value, such as a latency when no request succeeded or
+// the error rate when there were no requests, is NaN and fails its
+// thresholds.
+type Threshold struct {
+	Metric string
+	Op     string // one of <, <=, >, >= and ==
+	Value  float64
+}
+
+// thresholdOps lists the operators, longest first so that "<=" is not
+// taken for "<".
+var thresholdOps = []string{"<=", ">=", "==", "<", ">"}
+
+// ParseThreshold parses a threshold such as "p95<200ms", "error_rate<0.1%",
+// "rps>=1000" or "5xx==0". Latencies are durations, or seconds if they
+// have no unit, and rates may be given as fractions or percentages.
+func ParseThreshold(s string) (Threshold, error) {
+	var t Threshold
+	i := strings.IndexAny(s, "<>=")
+	if i < 0 {
+		return t, fmt.Errorf("threshold %q has no operator", s)
+	}
+	for _, op := range thresholdOps {
+		if strings.HasPrefix(s[i:], op) {
+			t.Op = op
+			break
+		}
+	}
+	if t.Op == "" {
+		return t, fmt.Errorf("threshold %q has an invalid operator", s)
+	}
+	t.Metric = strings.ToLower(strings.TrimSpace(s[:i]))
+	value := strings.TrimSpace(s[i+len(t.Op):])
+
+	var err error
+	switch {
+	case t.Metric == "avg" || t.Metric == "fastest" || t.Metric == "slowest":
+		t.Value, err = parseSeconds(value)
+	case strings.HasPrefix(t.Metric, "p"):
+		var p float64
+		if p, err = strconv.ParseFloat(t.Metric[1:], 64); err != nil || !isPctl(p) {
+			return t, fmt.Errorf("threshold %q: unknown metric %s, percentiles are %v", s, t.Metric, pctls)
+		}
+		t.Value, err = parseSeconds(value)
+	case t.Metric == "rps":
+		t.Value, err = strconv.ParseFloat(value, 64)
+	case t.Metric == "error_rate":
+		if strings.HasSuffix(value, "%") {
+			t.Value, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			t.Value /= 100
+		} else {
+			t.Value, err = strconv.ParseFloat(value, 64)
+		}
+	case len(t.Metric) == 3 && t.Metric[0] >= '1' && t.Metric[0] <= '5' && t.Metric[1:] == "xx":
+		t.Value, err = strconv.ParseFloat(value, 64)
+	default:
+		return t, fmt.Errorf("threshold %q: unknown metric %s", s, t.Metric)
+	}
+	if err != nil {
+		return t, fmt.Errorf("threshold %q: invalid value %q", s, value)
+	}
+	return t, nil
+}
+
+func parseSeconds(s string) (float64, error) {
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, nil
+	}
+	d, err := time.ParseDuration(s)
+	return d.Seconds(), err
+}
+
+func isPctl(p float64) bool {
+	for _, v := range pctls {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Threshold) String() string {
+	return fmt.Sprintf("%s %s %v", t.Metric, t.Op, t.Value)
+}
+
+// ThresholdResult is the outcome of checking a threshold.
+type ThresholdResult struct {
+	Threshold Threshold
+	Actual    float64
+	Pass      bool
+}
+
+// CheckThresholds checks the report against each threshold, and reports
+// whether it meets all of them.
+func CheckThresholds(r *Report, thresholds []Threshold) ([]ThresholdResult, bool) {
+	pass := true
+	res := make([]ThresholdResult, len(thresholds))
+	for i, t := range thresholds {
+		actual := t.actual(r)
+		res[i] = ThresholdResult{Threshold: t, Actual: actual, Pass: t.compare(actual)}
+		pass = pass && res[i].Pass
+	}
+	return res, pass
+}
+
+func (t Threshold) actual(r *Report) float64 {
+	switch {
+	case t.latency() && len(r.LatencyDistribution) == 0:
+		// No request succeeded.
+		return math.NaN()
+	case t.Metric == "avg":
+		return r.Average
+	case t.Metric == "fastest":
+		return r.Fastest
+	case t.Metric == "slowest":
+		return r.Slowest
+	case t.Metric == "rps":
+		return r.Rps
+	case t.Metric == "error_rate":
+		return r.errorRate()
+	case strings.HasSuffix(t.Metric, "xx"):
+		class := int(t.Metric[0]-'0') * 100
+		var n int
+		for code, c := range r.StatusCodeDist {
+			if code >= class && code < class+100 {
+				n += c
+			}
+		}
+		return float64(n)
+	default:
+		p, _ := strconv.ParseFloat(t.Metric[1:], 64)
+		return percentile(r.LatencyDistribution, p)
+	}
+}
+
+// latency reports whether the metric is a latency.
+func (t Threshold) latency() bool {
+	switch t.Metric {
+	case "avg", "fastest", "slowest":
+		return true
+	}
+	return strings.HasPrefix(t.Metric, "p")
+}
+
+// compare reports whether v meets the threshold, which it never does if
+// it is NaN.
+func (t Threshold) compare(v float64) bool {
+	switch t.Op {
+	case "<":
+		return v < t.Value
+	case "<=":
+		return v <= t.Value
+	case ">":
+		return v > t.Value
+	case ">=":
+		return v >= t.Value
+	default:
+		return v == t.Value
+	}
+}
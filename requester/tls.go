@@ -0,0 +1,192 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+// TLSOptions describes the TLS configuration of the connections, as
+// given on a command line.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of the certificate authorities to verify the
+	// certificates of the servers against. Setting it implies Verify.
+	CAFile string
+
+	// Verify verifies the certificates of the servers, against CAFile or
+	// else the roots of the system.
+	Verify bool
+
+	// CertFile and KeyFile are the PEM certificate and key presented to
+	// the servers that ask for one, such as for mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// ServerName is the name sent for SNI, and verified. Defaults to the
+	// Host of the request, or else the host of its URL.
+	ServerName string
+
+	// MinVersion and MaxVersion bound the TLS version, such as "1.2".
+	MinVersion string
+	MaxVersion string
+
+	// CipherSuites are the names of the cipher suites allowed for TLS
+	// 1.2 and below, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Those
+	// of TLS 1.3 cannot be chosen.
+	CipherSuites []string
+}
+
+// Config returns the TLS configuration o describes.
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: !o.Verify && o.CAFile == "",
+		ServerName:         o.ServerName,
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("requester: no certificates in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("requester: a client certificate needs both a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	var err error
+	if c.MinVersion, err = parseTLSVersion(o.MinVersion); err != nil {
+		return nil, err
+	}
+	if c.MaxVersion, err = parseTLSVersion(o.MaxVersion); err != nil {
+		return nil, err
+	}
+	if c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return nil, fmt.Errorf("requester: TLS version %s is above %s", o.MinVersion, o.MaxVersion)
+	}
+	for _, name := range o.CipherSuites {
+		id, ok := cipherSuites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("requester: unknown cipher suite %q, not one of %s", name, strings.Join(cipherSuiteNames(), ", "))
+		}
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+	return c, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version such as "1.2", or "" for none.
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("requester: unknown TLS version %q, not 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+// cipherSuites are the cipher suites that can be chosen, by name.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+func cipherSuiteNames() []string {
+	names := make([]string, 0, len(cipherSuites))
+	for name := range cipherSuites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tlsError is an error of the TLS handshake, such as a certificate that
+// does not verify or one the server rejects. It leaves out the URL of the
+// request, so those errors are reported together.
+type tlsError struct {
+	err error
+}
+
+func (e *tlsError) Error() string { return "TLS handshake: " + e.err.Error() }
+
+func (e *tlsError) Unwrap() error { return e.err }
+
+// classifyTLS returns err as a tlsError if it is one of the handshake, or
+// else err itself.
+func classifyTLS(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var header tls.RecordHeaderError
+	var op *net.OpError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return &tlsError{unknownAuthority}
+	case errors.As(err, &hostname):
+		return &tlsError{hostname}
+	case errors.As(err, &invalid):
+		return &tlsError{invalid}
+	case errors.As(err, &header):
+		return &tlsError{header}
+	case errors.As(err, &op) && op.Op == "remote error":
+		// Alerts from the server, such as when it rejects the client
+		// certificate, or has none.
+		return &tlsError{op}
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WindowReport summarizes the results of the requests started in a time
+// window of the run. Its Total is the length of the window.
+type WindowReport struct {
+	// Start is the start of the window since the start of the run.
+	Start time.Duration
+
+	GroupReport
+}
+
+// windows splits results into fixed time windows by their offset. A
+// window is summarized, and its histogram freed, once the requests
+// started in it can no longer be in flight, so long runs take little
+// memory.
+type windows struct {
+	size      time.Duration
+	grace     time.Duration // how long a window is kept open after it ends
+	precision int
+
+	closed []WindowReport
+	open   []*group // windows first, first+1, ...
+	first  int
+	late   int64 // results of windows already closed
+}
+
+// newWindows returns windows of the given size, for requests that time
+// out after timeout. Without a timeout, windows are closed two sizes
+// after they end, and the results of requests in flight for longer are
+// only counted as late.
+func newWindows(size, timeout time.Duration, precision int) *windows {
+	grace := timeout
+	if grace <= 0 {
+		grace = 2 * size
+	}
+	return &windows{size: size, grace: grace, precision: precision}
+}
+
+// add records res, and closes the windows that ended before elapsed.
+func (w *windows) add(res *result, elapsed time.Duration) {
+	i := int(res.offset / w.size)
+	if i < w.first {
+		// The window is already closed, which is only possible when
+		// requests are in flight for longer than the grace.
+		w.late++
+		return
+	}
+	for w.first+len(w.open) <= i {
+		w.open = append(w.open, newGroup("", w.precision))
+	}
+	w.open[i-w.first].add(res)
+
+	for len(w.open) > 1 && w.end(w.first)+w.grace < elapsed {
+		w.close(w.size)
+	}
+}
+
+func (w *windows) end(i int) time.Duration {
+	return time.Duration(i+1) * w.size
+}
+
+func (w *windows) close(d time.Duration) {
+	start := time.Duration(w.first) * w.size
+	w.open[0].name = fmt.Sprintf("%v-%v", start, start+d)
+	w.closed = append(w.closed, WindowReport{
+		Start:       start,
+		GroupReport: w.open[0].snapshot(d),
+	})
+	w.open[0] = nil
+	w.open = w.open[1:]
+	w.first++
+}
+
+// finish closes all the windows of a run of the given length.
+func (w *windows) finish(total time.Duration) {
+	for len(w.open) > 0 {
+		d := w.size
+		if start := time.Duration(w.first) * w.size; total-start < d {
+			d = total - start
+		}
+		if d < 0 {
+			d = 0
+		}
+		w.close(d)
+	}
+}
+
+// PrintWindows writes the time windows of the report to w, as "csv" with
+// a header or as "json", one JSONWindow object per line.
+func (r *Report) PrintWindows(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		for _, win := range r.Windows {
+			if err := enc.Encode(newJSONWindow(win)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if format != "csv" {
+		return fmt.Errorf("requester: unknown window format %q", format)
+	}
+
+	cw := csv.NewWriter(w)
+	header := []string{"start", "duration", "requests", "rps", "average", "fastest", "slowest"}
+	for _, p := range pctls {
+		header = append(header, "p"+strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	header = append(header, "errors", "failures", "1xx", "2xx", "3xx", "4xx", "5xx")
+	cw.Write(header)
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 4, 64)
+	}
+	for _, win := range r.Windows {
+		rec := []string{
+			f(win.Start.Seconds()), f(win.Total.Seconds()), strconv.FormatInt(win.NumRes, 10),
+			f(win.Rps), f(win.Average), f(win.Fastest), f(win.Slowest),
+		}
+		for _, p := range pctls {
+			rec = append(rec, f(percentile(win.LatencyDistribution, p)))
+		}
+		rec = append(rec, strconv.Itoa(sum(win.ErrorDist)), strconv.Itoa(sum(win.FailureDist)))
+		classes := statusClasses(win.StatusCodeDist)
+		for _, n := range classes[1:] {
+			rec = append(rec, strconv.Itoa(n))
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// statusClasses counts the responses of each status code class, such as
+// 2xx at index 2.
+func statusClasses(dist map[int]int) [6]int {
+	var classes [6]int
+	for code, n := range dist {
+		if c := code / 100; c > 0 && c < len(classes) {
+			classes[c] += n
+		}
+	}
+	return classes
+}
+
+func sum(dist map[string]int) int {
+	var n int
+	for _, v := range dist {
+		n += v
+	}
+	return n
+}